@@ -0,0 +1,19 @@
+// Package for generating brotli-encoded copies of compiled assets.
+//
+// When imported, this package registers the "br" content-coding with paste so
+// that Compile() writes a '.br' file at the maximum compression level next to
+// every compiled asset. Compiled servers will serve these files to clients
+// which accept brotli whether or not this package is imported.
+package brotli
+
+import "github.com/andybalholm/brotli"
+import "github.com/alexcrichton/go-paste"
+import "io"
+
+func init() {
+  paste.RegisterEncoding(paste.EncoderFunc(encode), "br", ".br")
+}
+
+func encode(w io.Writer) (io.WriteCloser, error) {
+  return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+}
@@ -0,0 +1,36 @@
+package brotli
+
+import "github.com/andybalholm/brotli"
+import "github.com/alexcrichton/go-paste"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func check(t *testing.T, e error) {
+  if e != nil {
+    t.Fatal(e)
+  }
+}
+
+func TestCompile(t *testing.T) {
+  wd, err := ioutil.TempDir(os.TempDir(), "paste")
+  check(t, err)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  check(t, ioutil.WriteFile(filepath.Join(wd, "foo.js"), []byte("foo"), 0644))
+
+  srv := paste.FileServer(paste.Config{Root: wd})
+  check(t, srv.Compile(dst))
+
+  f, err := os.Open(filepath.Join(dst, "foo.js.br"))
+  check(t, err)
+  defer f.Close()
+  s, err := ioutil.ReadAll(brotli.NewReader(f))
+  check(t, err)
+  if string(s) != "foo" {
+    t.Errorf("wrong contents:\n%s", string(s))
+  }
+}
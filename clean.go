@@ -0,0 +1,123 @@
+package paste
+
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
+import "time"
+
+// One version of an asset left behind in a compiled directory, which is all
+// of the files with the same digest
+type compiledVersion struct {
+  digest string
+  files  []string
+  mtime  time.Time
+}
+
+// Removes old versions of assets from a directory which has been compiled into
+// more than once, like foo-<digest>.js files (and their encoded copies and
+// source maps) whose digest is no longer in the manifest.
+//
+// For every asset, the version in the current manifest is always kept, along
+// with the 'keep' most recently compiled other versions and any version
+// compiled less than 'maxAge' ago. Files without a digest in their name are
+// never removed.
+//
+// It's safe to run this while a CompiledFileServer is serving out of the
+// directory, so long as the server was started with the current manifest or
+// one of the versions which are kept. Keeping at least one older version (or
+// a maxAge longer than it takes to roll out a deploy) means servers which are
+// still running the previous deploy keep working.
+func Clean(dst string, keep int, maxAge time.Duration) error {
+  mfile, err := os.Open(filepath.Join(dst, "manifest.json"))
+  if err != nil { return err }
+  m, err := readManifest(mfile)
+  mfile.Close()
+  if err != nil { return err }
+
+  /* Everything the manifest refers to stays no matter what */
+  current := make(map[string]string)
+  protected := make(map[string]bool)
+  for logical, entry := range m.Assets {
+    current[logical] = entry.Digest
+    file := entry.File
+    if file == "" {
+      ext := filepath.Ext(logical)
+      file = logical[:len(logical) - len(ext)] + "-" + entry.Digest + ext
+    }
+    for _, name := range []string{file, logical} {
+      name = filepath.Join(dst, filepath.FromSlash(name))
+      protected[name] = true
+      protected[name + ".map"] = true
+      for _, enc := range encodings {
+        protected[name + enc.ext] = true
+      }
+    }
+  }
+
+  /* Group all digested files by the asset they're a version of */
+  versions := make(map[string]map[string]*compiledVersion)
+  err = filepath.Walk(dst, func(name string, info os.FileInfo, err error) error {
+    if err != nil || info.IsDir() || protected[name] {
+      return err
+    }
+    rel, err := filepath.Rel(dst, name)
+    if err != nil { return err }
+    logical, digest := findDigest(stripCompiledExts(filepath.ToSlash(rel)),
+                                  m.DigestLength)
+    if digest == "" {
+      return nil
+    }
+    logical = "/" + logical
+    if versions[logical] == nil {
+      versions[logical] = make(map[string]*compiledVersion)
+    }
+    v, ok := versions[logical][digest]
+    if !ok {
+      v = &compiledVersion{digest: digest}
+      versions[logical][digest] = v
+    }
+    v.files = append(v.files, name)
+    if info.ModTime().After(v.mtime) {
+      v.mtime = info.ModTime()
+    }
+    return nil
+  })
+  if err != nil { return err }
+
+  cutoff := time.Now().Add(-maxAge)
+  for logical, byDigest := range versions {
+    old := make([]*compiledVersion, 0)
+    for digest, v := range byDigest {
+      if digest != current[logical] {
+        old = append(old, v)
+      }
+    }
+    sort.Slice(old, func(i, j int) bool {
+      return old[i].mtime.After(old[j].mtime)
+    })
+    for i, v := range old {
+      if i < keep || (maxAge > 0 && v.mtime.After(cutoff)) {
+        continue
+      }
+      for _, file := range v.files {
+        if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+          return err
+        }
+      }
+    }
+  }
+  return nil
+}
+
+// Strips the extensions of encoded copies and source maps off of the name of
+// a compiled file, returning the name of the asset it's a copy of
+func stripCompiledExts(name string) string {
+  name = strings.TrimSuffix(name, ".map")
+  for _, enc := range encodings {
+    if strings.HasSuffix(name, enc.ext) {
+      return strings.TrimSuffix(name, enc.ext)
+    }
+  }
+  return name
+}
@@ -0,0 +1,72 @@
+package paste
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+// Compiles a new version of 'a.js' into 'dst', pretending it was compiled
+// 'age' ago, and returns its digest
+func compileVersion(t *testing.T, srv *fileServer, wd, dst, contents string,
+                    age time.Duration) string {
+  stubFile(t, wd, "a.js", contents)
+  check(t, srv.Compile(dst))
+  asset, err := srv.Asset("a.js")
+  check(t, err)
+  then := time.Now().Add(-age)
+  files, err := filepath.Glob(filepath.Join(dst, "a-" + asset.Digest() + "*"))
+  check(t, err)
+  for _, file := range files {
+    check(t, os.Chtimes(file, then, then))
+  }
+  return asset.Digest()
+}
+
+func TestClean(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  srv.config.SourceMaps = true
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "b.png", "b")
+
+  v1 := compileVersion(t, srv, wd, dst, "1", 3 * time.Hour)
+  v2 := compileVersion(t, srv, wd, dst, "2", 2 * time.Hour)
+  v3 := compileVersion(t, srv, wd, dst, "3", time.Minute)
+  v4 := compileVersion(t, srv, wd, dst, "4", 4 * time.Hour)
+
+  exists := func(digest string, expected bool) {
+    for _, ext := range []string{".js", ".js.gz", ".js.map"} {
+      _, err := os.Stat(filepath.Join(dst, "a-" + digest + ext))
+      if (err == nil) != expected {
+        t.Errorf("a-%s%s exists: %v, expected %v", digest, ext, err == nil,
+                 expected)
+      }
+    }
+  }
+
+  /* the current version is kept even though it's the oldest, along with the
+     newest older one and anything from the last hour */
+  check(t, Clean(dst, 1, time.Hour))
+  exists(v1, false)
+  exists(v2, false)
+  exists(v3, true)
+  exists(v4, true)
+
+  check(t, Clean(dst, 0, 0))
+  exists(v3, false)
+  exists(v4, true)
+  for _, file := range []string{"a.js", "a.js.gz", "b.png", "manifest.json"} {
+    _, err = os.Stat(filepath.Join(dst, file))
+    check(t, err)
+  }
+
+  /* the directory still works for serving */
+  csrv, err := CompiledFileServer(dst)
+  check(t, err)
+  path, err := csrv.AssetPath("a.js")
+  check(t, err)
+  testEq(t, path, "/a-" + v4 + ".js")
+}
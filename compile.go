@@ -1,145 +1,623 @@
 package paste
 
-import "compress/gzip"
+import "context"
+import "crypto"
 import "encoding/json"
 import "errors"
 import "fmt"
 import "io"
+import "io/fs"
+import "io/ioutil"
+import "mime"
 import "net/http"
 import "os"
 import "path"
 import "path/filepath"
 import "runtime"
+import "sort"
+import "strings"
 import "sync"
 import "time"
 
-type manifest map[string]string
+// Format of the manifest.json written by Compile. The first versions of paste
+// wrote a flat object mapping logical names to digests instead, which
+// CompiledFileServer still understands.
+type manifest struct {
+  Version int                       `json:"version"`
+  Assets  map[string]*manifestEntry `json:"assets"`
+
+  /* How digests were computed, like "SHA-256", and how long they are */
+  DigestHash   string `json:"digest_hash,omitempty"`
+  DigestLength int    `json:"digest_length,omitempty"`
+
+  /* Other settings which change what assets compile to, see
+     Config.compileSettings() */
+  Settings string `json:"settings,omitempty"`
+}
+
+type manifestEntry struct {
+  Digest    string `json:"digest"`
+  Integrity string `json:"integrity,omitempty"`
+
+  /* Everything else was added in version 2. The file is the digested name of
+     the asset relative to the manifest, and the time is the modification time
+     of its sources. */
+  File         string                  `json:"file,omitempty"`
+  Size         int64                   `json:"size,omitempty"`
+  ModTime      time.Time               `json:"mtime"`
+  ContentType  string                  `json:"content_type,omitempty"`
+  Encodings    map[string]manifestFile `json:"encodings,omitempty"`
+  Dependencies []string                `json:"dependencies,omitempty"`
+
+  /* What the asset was compiled from, by logical name, so that compiling
+     again can tell whether it needs to be built at all. Links are the logical
+     names of the assets it links to, and the source map is relative to the
+     manifest like the file. */
+  Sources   map[string]manifestSource `json:"sources,omitempty"`
+  Links     []string                  `json:"links,omitempty"`
+  SourceMap string                    `json:"source_map,omitempty"`
+}
+
+// A source file of an asset as it was when the asset was compiled. The file is
+// relative to the root it's in. Directories are those listed by require_tree
+// (with a "/..." suffix) and require_directory, along with what was in them.
+type manifestSource struct {
+  File        string              `json:"file"`
+  Size        int64               `json:"size"`
+  ModTime     time.Time           `json:"mtime"`
+  Directories map[string][]string `json:"directories,omitempty"`
+}
+
+// An encoded copy of an asset, with its name relative to the manifest
+type manifestFile struct {
+  File string `json:"file"`
+  Size int64  `json:"size"`
+}
+
+const manifestVersion = 2
+
+func newManifest() *manifest {
+  return &manifest{ Version: manifestVersion,
+                    Assets: make(map[string]*manifestEntry) }
+}
+
+// Reads a manifest, in either the current or the flat format
+func readManifest(r io.Reader) (*manifest, error) {
+  bits, err := ioutil.ReadAll(r)
+  if err != nil { return nil, err }
+  var raw map[string]json.RawMessage
+  if err = json.Unmarshal(bits, &raw); err != nil {
+    return nil, err
+  }
+
+  m := newManifest()
+  if _, ok := raw["version"]; !ok {
+    /* The original manifests just map logical names to digests */
+    m.Version = 1
+    for logical, digest := range raw {
+      entry := &manifestEntry{}
+      if err = json.Unmarshal(digest, &entry.Digest); err != nil {
+        return nil, err
+      }
+      m.Assets[logical] = entry
+    }
+  } else if err = json.Unmarshal(bits, m); err != nil {
+    return nil, err
+  } else if m.Version > manifestVersion {
+    return nil, errors.New(fmt.Sprintf("unknown manifest version: %d",
+                                       m.Version))
+  }
+
+  /* Digests used to always be md5 */
+  if m.DigestHash == "" {
+    m.DigestHash, m.DigestLength = crypto.MD5.String(), 32
+  }
+  return m, nil
+}
 
 type compiledServer struct {
   root string
+  fs fs.FS
   precompiled map[string]*precompiledAsset
   config Config
 }
 
 type precompiledAsset struct {
-  path    string
-  logical string
-  digest  string
+  path      string
+  logical   string
+  digest    string
+  integrity string
+  mtime     time.Time
+  ctype     string
+  files    []encodedFile
+  mappath  string
+  srv      *compiledServer
+}
+
+// What changed when compiling assets into a directory which had been compiled
+// into before. Each list holds logical names, sorted.
+type CompileReport struct {
+  // Assets which weren't in the previous manifest
+  Added []string
+
+  // Assets which were in the previous manifest, but whose output changed
+  Changed []string
+
+  // Assets which were in the previous manifest, but no longer exist
+  Removed []string
+
+  // Assets whose output was already there and was left alone
+  Unchanged []string
+
+  // Assets whose output is the same as before, but had to be written again
+  // because some of it (like a compressed copy) was missing or modified
+  Rewritten []string
 }
 
 func (s *fileServer) Compile(dest string) error {
+  _, err := s.CompileContext(context.Background(), dest)
+  return err
+}
+
+func (s *fileServer) CompileContext(ctx context.Context,
+                                   dest string) (*CompileReport, error) {
   dest, err := filepath.Abs(dest)
+  if err != nil { return nil, err }
+
+  h, err := s.config.integrityHash()
+  if err != nil { return nil, err }
+  manifest := newManifest()
+  manifest.DigestHash = s.config.digestHash().String()
+  manifest.DigestLength = s.config.digestLength()
+  manifest.Settings = s.config.compileSettings()
+  previous := s.previousManifest(dest, manifest)
+  report := &CompileReport{}
+
+  /* Compile the entry points, then whatever they link to which hasn't been
+     compiled yet, and so on */
+  logicals, err := s.entryPoints(ctx)
+  if err != nil { return nil, err }
+  seen := make(map[string]bool)
+  for _, logical := range logicals {
+    seen[logical] = true
+  }
+  for len(logicals) > 0 {
+    links, err := s.compileBatch(ctx, dest, logicals, h, manifest, previous,
+                                 report)
+    if err != nil { return nil, err }
+    logicals = nil
+    for _, link := range links {
+      if !seen[link] {
+        seen[link] = true
+        logicals = append(logicals, link)
+      }
+    }
+  }
+
+  for logical := range previous.Assets {
+    if _, ok := manifest.Assets[logical]; !ok {
+      report.Removed = append(report.Removed, logical)
+    }
+  }
+  for _, list := range [][]string{report.Added, report.Changed,
+                                  report.Removed, report.Unchanged,
+                                  report.Rewritten} {
+    sort.Strings(list)
+  }
+
+  return report, manifest.write(dest)
+}
+
+// Writes out the manifest into the given directory. The manifest is replaced
+// all at once, so servers starting up while compiling never see half of one.
+func (m *manifest) write(dest string) error {
+  mfile, err := ioutil.TempFile(dest, "manifest")
   if err != nil { return err }
+  err = mfile.Chmod(0644)
+  if err == nil {
+    err = json.NewEncoder(mfile).Encode(m)
+  }
+  if cerr := mfile.Close(); err == nil {
+    err = cerr
+  }
+  if err == nil {
+    err = os.Rename(mfile.Name(), filepath.Join(dest, "manifest.json"))
+  }
+  if err != nil {
+    os.Remove(mfile.Name())
+  }
+  return err
+}
 
+// Returns the logical names of all assets which should be compiled, which is
+// everything matching Config.Precompile, or everything if that's empty
+func (s *fileServer) entryPoints(ctx context.Context) ([]string, error) {
+  /* An asset in more than one root is only compiled from the first one,
+     which is the one resolving its logical path finds */
+  seen := make(map[string]bool)
+  logicals := make([]string, 0)
+  err := s.walk(func(root, path string) error {
+    if err := ctx.Err(); err != nil {
+      return err
+    }
+    /* Processed extensions are stripped off and aliases are mapped back to
+       what they're aliases for in the output file */
+    rel, _ := s.relativeTo(root, path)
+    logical := s.registry().logicalName(rel)
+    if seen[logical] {
+      return nil
+    }
+    seen[logical] = true
+    ok, err := s.config.precompiled(logical)
+    if ok {
+      logicals = append(logicals, logical)
+    }
+    return err
+  })
+  return logicals, err
+}
+
+// Returns whether an asset is one of the entry points to compile. Patterns
+// without a slash match the base name of the asset, and others match the
+// whole logical name.
+func (c *Config) precompiled(logical string) (bool, error) {
+  if len(c.Precompile) == 0 {
+    return true, nil
+  }
+  logical = strings.TrimPrefix(logical, "/")
+  for _, pattern := range c.Precompile {
+    name := logical
+    if !strings.Contains(pattern, "/") {
+      name = path.Base(logical)
+    }
+    ok, err := path.Match(strings.TrimPrefix(pattern, "/"), name)
+    if err != nil {
+      return false, errors.New("bad Precompile pattern: " + pattern)
+    } else if ok {
+      return true, nil
+    }
+  }
+  return false, nil
+}
+
+// Compiles the given assets in parallel, returning the logical names of all
+// the assets they link to
+func (s *fileServer) compileBatch(ctx context.Context, dest string,
+                                  logicals []string, h crypto.Hash,
+                                  m, previous *manifest,
+                                  report *CompileReport) ([]string, error) {
   /* Compiling takes awhile, parallelize! */
   paths := make(chan string)
-  manifest := make(manifest)
+  links := make([]string, 0)
+  var err error
   var wg sync.WaitGroup
-
   for i := 0; i < runtime.NumCPU(); i++ {
     go func() {
       for path := range paths {
-        myerr := s.compileAsset(dest, path, manifest)
+        linked, myerr := s.compileAsset(ctx, dest, path, h, m, previous,
+                                        report)
+        s.Lock()
         if myerr != nil {
           err = myerr
         }
+        for _, l := range linked {
+          links = append(links, strings.TrimPrefix(l, "/"))
+        }
+        s.Unlock()
       }
       wg.Done()
     }()
     wg.Add(1)
   }
 
-  myerr := filepath.Walk(s.config.Root,
-                         func(path string, info os.FileInfo, err error) error {
-    if err != nil { return err }
-    if info.IsDir() { return nil }
-    paths <- path
-    return nil
-  })
-
+  for _, logical := range logicals {
+    select {
+    case paths <- logical:
+      continue
+    case <-ctx.Done():
+    }
+    break
+  }
   close(paths)
   wg.Wait()
 
   /* Doesn't really matter what error to return as long as some error is
      returned if there was an error somewhere */
-  if myerr != nil {
-    return myerr
-  } else if err != nil {
-    return err
+  if err == nil {
+    err = ctx.Err()
   }
+  return links, err
+}
 
-  mfile, err := os.Create(filepath.Join(dest, "manifest.json"))
-  if err != nil { return err }
-  defer mfile.Close()
-  enc := json.NewEncoder(mfile)
-  return enc.Encode(manifest)
-}
-
-func (s *fileServer) compileAsset(dest, path string, m manifest) error {
-  /* If this file's extension is an alias for another, then we should use the
-     alias instead of the actual extension in the output file */
-  ext := filepath.Ext(path)
-  alias := ext
-  for a, possibilities := range aliases {
-    for _, p := range possibilities {
-      if p == ext {
-        alias = a
+// Describes the settings other than the digest hash which change what assets
+// compile to. Output compiled with different settings is never reused.
+//
+// Processors aren't part of this, so after changing what a processor does,
+// either change Config.Version or compile into an empty directory.
+func (c *Config) compileSettings() string {
+  return fmt.Sprintf("version=%s+%s compressed=%v source_maps=%v", Version,
+                     c.Version, c.Compressed, c.SourceMaps)
+}
+
+// Reads the manifest of whatever was compiled into 'dest' before. If there's
+// none, or the assets in it were compiled differently from the new manifest,
+// an empty manifest is returned so nothing is reused.
+func (s *fileServer) previousManifest(dest string, m *manifest) *manifest {
+  f, err := os.Open(filepath.Join(dest, "manifest.json"))
+  if err != nil {
+    return newManifest()
+  }
+  defer f.Close()
+  previous, err := readManifest(f)
+  if err != nil || previous.DigestHash != m.DigestHash ||
+     previous.DigestLength != m.DigestLength ||
+     previous.Settings != m.Settings {
+    return newManifest()
+  }
+  return previous
+}
+
+// Returns the source files which went into an asset, and into everything it
+// links to, by logical name
+func manifestSources(a Asset) map[string]manifestSource {
+  sources := make(map[string]manifestSource)
+  var add func(a Asset)
+  add = func(a Asset) {
+    a = unwrap(a)
+    logical := a.LogicalName()
+    if _, ok := sources[logical]; ok {
+      return
+    }
+    var static *staticAsset
+    p, processed := a.(*processedAsset)
+    if processed {
+      static = p.static
+    } else if static, processed = a.(*staticAsset); !processed {
+      return
+    }
+    src := manifestSource{ File: static.srv.relativeName(static.pathname),
+                           Size: static.size, ModTime: static.mtime.UTC() }
+    sources[logical] = src
+    if p == nil {
+      return
+    }
+    if len(p.directories) > 0 {
+      src.Directories = p.directories
+      sources[logical] = src
+    }
+    for _, f := range p.flattened {
+      add(f)
+    }
+    for _, l := range p.links {
+      add(l)
+    }
+  }
+  add(a)
+  return sources
+}
+
+// Returns whether the sources an asset was compiled from are all still the
+// same, which can be told without building the asset
+func (s *fileServer) sourcesUnchanged(sources map[string]manifestSource) bool {
+  if len(sources) == 0 {
+    return false
+  }
+  for logical, src := range sources {
+    pathname, err := s.resolve(logical)
+    if err != nil || s.relativeName(pathname) != src.File {
+      return false
+    }
+    stat, err := s.stat(pathname)
+    if err != nil || stat.Size() != src.Size ||
+       !stat.ModTime().Equal(src.ModTime) {
+      return false
+    }
+
+    /* Listing a directory needs an asset of the type being listed */
+    lister := &processedAsset{ static: &staticAsset{ logical: logical,
+                                                     srv: s } }
+    for dir, found := range src.Directories {
+      recursive := strings.HasSuffix(dir, "/...")
+      now, err := lister.listDirectory(strings.TrimSuffix(dir, "/..."),
+                                       recursive)
+      if err != nil || strings.Join(now, "\n") != strings.Join(found, "\n") {
+        return false
       }
     }
   }
+  return true
+}
 
-  /* Actual compilation of the asset itself */
-  logical := path[len(s.config.Root) + 1 : len(path) - len(ext)] + alias
-  asset, err := s.Asset(logical)
-  if err != nil { return err }
+// Returns whether all the files a previous compile wrote for an asset are
+// still there as they were written
+func (s *fileServer) upToDate(dest, logical string, entry *manifestEntry,
+                              h crypto.Hash) bool {
+  if entry == nil || entry.File == "" ||
+     !strings.HasPrefix(entry.Integrity, integrityNames[h] + "-") {
+    return false
+  }
+  sized := func(name string, size int64) bool {
+    stat, err := os.Stat(filepath.Join(dest, filepath.FromSlash(name)))
+    return err == nil && stat.Size() == size
+  }
+  if !sized(entry.File, entry.Size) || !sized(logical, entry.Size) {
+    return false
+  }
+  encodings := s.config.enabledEncodings()
+  if len(encodings) != len(entry.Encodings) {
+    return false
+  }
+  for _, enc := range encodings {
+    f, ok := entry.Encodings[enc.name]
+    if !ok || !sized(f.File, f.Size) || !sized(logical + enc.ext, f.Size) {
+      return false
+    }
+  }
+  if entry.SourceMap != "" {
+    map1, err1 := os.Stat(filepath.Join(dest, filepath.FromSlash(entry.SourceMap)))
+    map2, err2 := os.Stat(filepath.Join(dest, logical + ".map"))
+    if err1 != nil || err2 != nil || map1.Size() != map2.Size() {
+      return false
+    }
+  }
+  return true
+}
+
+// Returns the logical names of all assets an asset links to
+func assetLinks(a Asset) []string {
+  p, ok := unwrap(a).(*processedAsset)
+  if !ok {
+    return nil
+  }
+  links := make([]string, 0, len(p.links))
+  for _, l := range p.links {
+    links = append(links, path.Join("/", l.LogicalName()))
+  }
+  return links
+}
+
+// Compiles one asset into 'dest', returning the logical names of the assets it
+// links to, which need compiling as well
+func (s *fileServer) compileAsset(ctx context.Context, dest, logical string,
+                                  h crypto.Hash, m, previous *manifest,
+                                  report *CompileReport) ([]string, error) {
+  unchanged := func(entry manifestEntry) {
+    s.Lock()
+    m.Assets["/" + logical] = &entry
+    report.Unchanged = append(report.Unchanged, "/" + logical)
+    s.Unlock()
+  }
+
+  /* If nothing the asset was compiled from has changed and all its output
+     is still there, it doesn't even need building */
+  old := previous.Assets["/" + logical]
+  if old != nil && s.sourcesUnchanged(old.Sources) &&
+     s.upToDate(dest, logical, old, h) {
+    unchanged(*old)
+    return old.Links, nil
+  }
+
+  asset, err := s.AssetContext(ctx, logical)
+  if err != nil { return nil, err }
+  links := assetLinks(asset)
+
+  /* Sources may have only been touched, in which case the output is the
+     same and only the manifest needs updating */
+  if old != nil && old.Digest == asset.Digest() &&
+     s.upToDate(dest, logical, old, h) {
+    entry := *old
+    entry.ModTime = asset.ModTime().UTC()
+    entry.Dependencies = assetDependencies(asset)
+    entry.Sources = manifestSources(asset)
+    entry.Links = links
+    unchanged(entry)
+    return links, nil
+  }
 
   dst := filepath.Join(dest, logical)
-  ext = filepath.Ext(dst)
+  ext := filepath.Ext(dst)
   digest := dst[:len(dst) - len(ext)] + "-" + asset.Digest() + ext
   os.MkdirAll(filepath.Dir(dst), 0755)
 
-  /* foo.js */
-  out, err := os.Create(dst)
-  if err != nil { return err }
-  defer out.Close()
+  /* Encoders need to be closed before the files they write to, so everything
+     is closed in reverse order */
+  closers := make([]io.Closer, 0)
+  closeAll := func() error {
+    var err error
+    for i := len(closers) - 1; i >= 0; i-- {
+      if e := closers[i].Close(); e != nil && err == nil {
+        err = e
+      }
+    }
+    closers = nil
+    return err
+  }
+  defer closeAll()
 
-  /* foo.js.gz */
-  _outgz, err := os.Create(dst + ".gz")
-  if err != nil { return err }
-  defer _outgz.Close()
-  outgz, err := gzip.NewWriterLevel(_outgz, gzip.BestCompression)
-  if err != nil { return err }
-  defer outgz.Close()
+  /* foo.js and foo-hexdigest.js */
+  writers := make([]io.Writer, 0)
+  for _, name := range []string{dst, digest} {
+    out, err := os.Create(name)
+    if err != nil { return nil, err }
+    closers = append(closers, out)
+    writers = append(writers, out)
 
-  /* foo-hexdigest.js */
-  outdigest, err := os.Create(digest)
-  if err != nil { return err }
-  defer outdigest.Close()
+    /* foo.js.gz, foo-hexdigest.js.gz, etc. */
+    for _, enc := range s.config.enabledEncodings() {
+      _out, err := os.Create(name + enc.ext)
+      if err != nil { return nil, err }
+      closers = append(closers, _out)
+      out, err := enc.encoder.Encode(_out)
+      if err != nil { return nil, err }
+      closers = append(closers, out)
+      writers = append(writers, out)
+    }
+  }
 
-  /* foo-hexdigest.js.gz */
-  _outdigestgz, err := os.Create(digest + ".gz")
-  if err != nil { return err }
-  defer _outdigestgz.Close()
-  outdigestgz, err := gzip.NewWriterLevel(_outdigestgz, gzip.BestCompression)
-  if err != nil { return err }
-  defer outdigestgz.Close()
+  /* The integrity is of exactly what's served */
+  hash := h.New()
+  writers = append(writers, hash)
 
   /* input file (the compiled asset) */
-  _in, err := os.Open(asset.Pathname())
-  if err != nil { return err }
-  defer _in.Close()
+  in, err := openAsset(asset, asset.Pathname())
+  if err != nil { return nil, err }
+  defer in.Close()
 
   /* And finally, copy everything from the input */
-  in := io.TeeReader(_in, out)
-  in = io.TeeReader(in, outdigest)
-  in = io.TeeReader(in, outgz)
-  _, err = io.Copy(outdigestgz, in)
-  if err != nil { return err }
+  size, err := io.Copy(io.MultiWriter(writers...), in)
+  if err != nil { return nil, err }
+  if err = closeAll(); err != nil { return nil, err }
+
+  /* foo.js.map and foo-hexdigest.js.map */
+  srcmap := ""
+  if m, ok := unwrap(asset).(mappedAsset); ok && m.sourceMap() != "" {
+    bits, err := ioutil.ReadFile(m.sourceMap())
+    if err != nil { return nil, err }
+    for _, name := range []string{dst, digest} {
+      if err = ioutil.WriteFile(name + ".map", bits, 0644); err != nil {
+        return nil, err
+      }
+    }
+    srcmap = entryFile(dest, digest + ".map")
+  }
+
+  entry := &manifestEntry{
+    Digest: asset.Digest(),
+    Integrity: formatIntegrity(h, hash.Sum(nil)),
+    File: entryFile(dest, digest),
+    Size: size,
+    ModTime: asset.ModTime().UTC(),
+    ContentType: mime.TypeByExtension(ext),
+    Encodings: make(map[string]manifestFile),
+    Dependencies: assetDependencies(asset),
+    Sources: manifestSources(asset),
+    Links: links,
+    SourceMap: srcmap,
+  }
+  for _, enc := range s.config.enabledEncodings() {
+    stat, err := os.Stat(digest + enc.ext)
+    if err != nil { return nil, err }
+    entry.Encodings[enc.name] = manifestFile{ File: entry.File + enc.ext,
+                                              Size: stat.Size() }
+  }
 
   s.Lock()
-  m["/" + logical] = asset.Digest()
+  m.Assets["/" + logical] = entry
+  if old == nil {
+    report.Added = append(report.Added, "/" + logical)
+  } else if old.Digest == entry.Digest {
+    report.Rewritten = append(report.Rewritten, "/" + logical)
+  } else {
+    report.Changed = append(report.Changed, "/" + logical)
+  }
   s.Unlock()
-  return nil
+  return links, nil
+}
+
+// Returns the name of a file written into 'dest' as it's put in the manifest
+func entryFile(dest, name string) string {
+  file, _ := filepath.Rel(dest, name)
+  return filepath.ToSlash(file)
 }
 
 // Creates a new compiled file server to serve up files. A compiled file server
@@ -151,29 +629,128 @@ func (s *fileServer) compileAsset(dest, path string, m manifest) error {
 // environment if necessary. None of the operations of this server touch the
 // filesystem except for actually serving up the files. This assumes that all
 // assets have been precompiled and will do no more processing.
+//
+// Clients which send an Accept-Encoding allowing gzip (or another encoding
+// generated by Compile(), like brotli) are served the encoded versions of
+// assets instead. The client's preferred encoding is picked, falling back to
+// the smallest file.
 func CompiledFileServer(root string) (Server, error) {
-  srv := &compiledServer { root: root,
+  return newCompiledServer(root, nil)
+}
+
+// Same as CompiledFileServer(), except that the compiled assets are read out of
+// the given filesystem instead of a directory. The top of the filesystem must
+// be the destination that was passed to Compile(), so for example the output
+// can be embedded into a binary:
+//
+//    //go:embed precompiled
+//    var precompiled embed.FS
+//
+//    func init() {
+//      assets, err := fs.Sub(precompiled, "precompiled")
+//      if err != nil { panic(err) }
+//      srv, err := paste.CompiledFileServerFS(assets)
+//      // ...
+//    }
+func CompiledFileServerFS(fsys fs.FS) (Server, error) {
+  return newCompiledServer(".", fsys)
+}
+
+func newCompiledServer(root string, fsys fs.FS) (Server, error) {
+  srv := &compiledServer { root: root, fs: fsys,
                            precompiled: make(map[string]*precompiledAsset) }
+  srv.config.Root = root
+  srv.config.FS = fsys
 
-  manifest := make(manifest)
-  mfile, err := os.Open(filepath.Join(root, "manifest.json"))
+  mfile, err := srv.open(srv.join("manifest.json"))
   if err != nil {
     return nil, err
   }
   defer mfile.Close()
-  enc := json.NewDecoder(mfile)
-  err = enc.Decode(&manifest)
+  manifest, err := readManifest(mfile)
   if err != nil { return nil, err }
+  hash, ok := hashByName(manifest.DigestHash)
+  if !ok {
+    return nil, errors.New("unknown digest hash: " + manifest.DigestHash)
+  }
+  srv.config.DigestHash = hash
+  srv.config.DigestLength = manifest.DigestLength
+
+  /* Older manifests don't know when assets were modified, so the best guess
+     is when they were compiled */
+  var compiled time.Time
+  if stat, err := mfile.Stat(); err == nil {
+    compiled = stat.ModTime()
+  }
+
+  for path, entry := range manifest.Assets {
+    asset := &precompiledAsset{ logical: path, path: srv.join(path),
+                                digest: entry.Digest,
+                                integrity: entry.Integrity,
+                                mtime: entry.ModTime,
+                                ctype: entry.ContentType, srv: srv }
+    if entry.File != "" {
+      asset.path = srv.join(entry.File)
+    }
+    if asset.mtime.IsZero() {
+      asset.mtime = compiled
+    }
 
-  for path, digest := range manifest {
-    srv.precompiled[path] = &precompiledAsset{ logical: path,
-                                               path: filepath.Join(root, path),
-                                               digest: digest }
+    /* Older manifests don't say which encoded versions exist, so look for
+       all of them */
+    if entry.Encodings != nil {
+      for _, enc := range encodings {
+        if f, ok := entry.Encodings[enc.name]; ok {
+          file := encodedFile{ encoding: enc.name, path: srv.join(f.File),
+                               size: f.Size }
+          asset.files = append(asset.files, file)
+        }
+      }
+    } else {
+      for _, enc := range encodings {
+        stat, err := srv.stat(asset.path + enc.ext)
+        if err == nil {
+          file := encodedFile{ encoding: enc.name, path: asset.path + enc.ext,
+                               size: stat.Size() }
+          asset.files = append(asset.files, file)
+        }
+      }
+    }
+    if entry.SourceMap != "" {
+      asset.mappath = srv.join(entry.SourceMap)
+    } else if manifest.Version < manifestVersion {
+      /* Neither do they say which assets have source maps */
+      if _, err := srv.stat(asset.path + ".map"); err == nil {
+        asset.mappath = asset.path + ".map"
+      }
+    }
+    srv.precompiled[path] = asset
   }
 
   return srv, nil
 }
 
+func (c *compiledServer) join(logical string) string {
+  if c.fs == nil {
+    return filepath.Join(c.root, logical)
+  }
+  return path.Join(c.root, logical)
+}
+
+func (c *compiledServer) open(name string) (fs.File, error) {
+  if c.fs == nil {
+    return os.Open(name)
+  }
+  return c.fs.Open(name)
+}
+
+func (c *compiledServer) stat(name string) (fs.FileInfo, error) {
+  if c.fs == nil {
+    return os.Stat(name)
+  }
+  return fs.Stat(c.fs, name)
+}
+
 func (c *compiledServer) AssetPath(logical string) (string, error){
   asset, err := c.Asset(logical)
   if err != nil {
@@ -188,6 +765,11 @@ func (c *compiledServer) Compile(dst string) error {
   return errors.New("Compiled server can't compile assets again")
 }
 
+func (c *compiledServer) CompileContext(ctx context.Context,
+                                       dst string) (*CompileReport, error) {
+  return nil, c.Compile(dst)
+}
+
 func (s *compiledServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
   serveHTTP(s, w, r)
 }
@@ -200,6 +782,11 @@ func (s *compiledServer) Asset(logical string) (Asset, error) {
   return nil, errors.New(fmt.Sprintf("asset not precompiled: %s", logical))
 }
 
+func (s *compiledServer) AssetContext(ctx context.Context,
+                                      logical string) (Asset, error) {
+  return s.Asset(logical)
+}
+
 func (s *compiledServer) Config() *Config {
   return &s.config
 }
@@ -208,4 +795,11 @@ func (a *precompiledAsset) Digest() string      { return a.digest }
 func (a *precompiledAsset) Pathname() string    { return a.path }
 func (a *precompiledAsset) LogicalName() string { return a.logical }
 func (a *precompiledAsset) Stale() bool         { return false }
-func (a *precompiledAsset) ModTime() time.Time  { return time.Now() }
+func (a *precompiledAsset) ModTime() time.Time  { return a.mtime }
+func (a *precompiledAsset) encoded() []encodedFile { return a.files }
+func (a *precompiledAsset) sourceMap() string      { return a.mappath }
+func (a *precompiledAsset) contentType() string    { return a.ctype }
+
+func (a *precompiledAsset) open(name string) (fs.File, error) {
+  return a.srv.open(name)
+}
@@ -1,13 +1,31 @@
 package paste
 
+import "bytes"
+import "compress/flate"
 import "compress/gzip"
+import "context"
+import "crypto"
+import "crypto/sha256"
+import "encoding/hex"
 import "io"
 import "io/ioutil"
 import "net/http"
 import "net/http/httptest"
 import "os"
+import "path/filepath"
 import "testing"
+import "testing/fstest"
 import "strings"
+import "sync/atomic"
+import "time"
+
+func init() {
+  RegisterEncoding(EncoderFunc(deflate), "deflate", ".zz")
+}
+
+func deflate(w io.Writer) (io.WriteCloser, error) {
+  return flate.NewWriter(w, flate.NoCompression)
+}
 
 func stubCompiledServer(t *testing.T) (*compiledServer, string) {
   srv, wd := stubServer(t)
@@ -57,26 +75,71 @@ func TestCompile(t *testing.T) {
   contains("/foo/foo-" + asset.Digest() + ".js.gz", "bar1")
 }
 
+/* The default client asks for gzip behind our backs, so use one which
+   doesn't to be explicit about what's being requested */
+var identityClient = &http.Client{
+  Transport: &http.Transport{DisableCompression: true},
+}
+
 func TestCompiledServer(t *testing.T) {
   srv, dst := stubCompiledServer(t)
   defer os.RemoveAll(dst)
   hsrv := httptest.NewServer(srv)
   defer hsrv.Close()
 
-  resp, err := http.Get(hsrv.URL + "/foo/foo.js")
+  resp, err := identityClient.Get(hsrv.URL + "/foo/foo.js")
   check(t, err)
   tag := ValidateHeaders(t, resp, "bar1", "")
-  resp, err = http.Get(hsrv.URL + "/foo/foo-" + tag + ".js")
+  resp, err = identityClient.Get(hsrv.URL + "/foo/foo-" + tag + ".js")
   check(t, err)
   ValidateHeaders(t, resp, "bar1", tag)
-  resp, err = http.Get(hsrv.URL + "/foo.png")
+  resp, err = identityClient.Get(hsrv.URL + "/foo.png")
   check(t, err)
   tag = ValidateHeaders(t, resp, "bar3", "")
-  resp, err = http.Get(hsrv.URL + "/foo-" + tag + ".png")
+  resp, err = identityClient.Get(hsrv.URL + "/foo-" + tag + ".png")
   check(t, err)
   ValidateHeaders(t, resp, "bar3", tag)
 }
 
+func TestCompiledServerGzip(t *testing.T) {
+  srv, dst := stubCompiledServer(t)
+  defer os.RemoveAll(dst)
+  hsrv := httptest.NewServer(srv)
+  defer hsrv.Close()
+  asset, err := srv.Asset("foo/foo.js")
+  check(t, err)
+
+  get := func(encoding string) *http.Response {
+    req, err := http.NewRequest("GET", hsrv.URL + "/foo/foo.js", nil)
+    check(t, err)
+    req.Header.Set("Accept-Encoding", encoding)
+    resp, err := identityClient.Do(req)
+    check(t, err)
+    if resp.Header.Get("Vary") != "Accept-Encoding" {
+      t.Errorf("wrong vary '%s'", resp.Header.Get("Vary"))
+    }
+    return resp
+  }
+
+  resp := get("br, gzip;q=0.5")
+  if resp.Header.Get("Content-Encoding") != "gzip" {
+    t.Fatalf("expected gzip, got '%s'", resp.Header.Get("Content-Encoding"))
+  }
+  testEq(t, resp.Header.Get("ETag"), `"` + asset.Digest() + `-gzip"`)
+  if !strings.Contains(resp.Header.Get("Content-Type"), "javascript") {
+    t.Errorf("wrong content type: %s", resp.Header.Get("Content-Type"))
+  }
+  input, err := gzip.NewReader(resp.Body)
+  check(t, err)
+  s, err := ioutil.ReadAll(input)
+  check(t, err)
+  testEq(t, string(s), "bar1")
+
+  resp = get("gzip;q=0, identity")
+  testEq(t, resp.Header.Get("Content-Encoding"), "")
+  testEq(t, ValidateHeaders(t, resp, "bar1", ""), asset.Digest())
+}
+
 func TestCompiledServerAssetPath(t *testing.T) {
   srv, dst := stubCompiledServer(t)
   defer os.RemoveAll(dst)
@@ -94,3 +157,512 @@ func TestCompiledServerAssetPath(t *testing.T) {
   check("foo/foo.js", false)
   check("/foo/foo.js", false)
 }
+
+func TestCompiledServerNegotiatesEncoding(t *testing.T) {
+  srv, dst := stubCompiledServer(t)
+  defer os.RemoveAll(dst)
+  hsrv := httptest.NewServer(srv)
+  defer hsrv.Close()
+
+  encoding := func(accept string) string {
+    req, err := http.NewRequest("GET", hsrv.URL + "/foo.css", nil)
+    check(t, err)
+    req.Header.Set("Accept-Encoding", accept)
+    resp, err := identityClient.Do(req)
+    check(t, err)
+    resp.Body.Close()
+    return resp.Header.Get("Content-Encoding")
+  }
+
+  /* client preference wins, otherwise the smaller file does */
+  testEq(t, encoding("gzip, deflate;q=0.5"), "gzip")
+  testEq(t, encoding("gzip, deflate"), "deflate")
+  testEq(t, encoding("*;q=0.1, gzip"), "gzip")
+  testEq(t, encoding("br, zstd"), "")
+}
+
+func TestCompileEncodings(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "foo.js", "bar1")
+
+  srv.Config().Encodings = []string{"deflate"}
+  check(t, srv.Compile(dst))
+  _, err = os.Stat(dst + "/foo.js.zz")
+  check(t, err)
+  if _, err = os.Stat(dst + "/foo.js.gz"); err == nil {
+    t.Errorf("gzip should have been disabled")
+  }
+}
+
+func TestCompileFS(t *testing.T) {
+  tmpdir, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(tmpdir)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  fsys := fstest.MapFS{
+    "foo/foo.js": &fstest.MapFile{Data: []byte("//= require bar\nfoo")},
+    "bar.js": &fstest.MapFile{Data: []byte("bar")},
+  }
+
+  srv := FileServer(Config{FS: fsys, TempDir: tmpdir})
+  check(t, srv.Compile(dst))
+  s, err := ioutil.ReadFile(dst + "/foo/foo.js")
+  check(t, err)
+  testEq(t, string(s), "bar\n//= require bar\nfoo")
+  s, err = ioutil.ReadFile(dst + "/bar.js")
+  check(t, err)
+  testEq(t, string(s), "bar")
+}
+
+func TestCompiledServerFS(t *testing.T) {
+  _, dst := stubCompiledServer(t)
+  defer os.RemoveAll(dst)
+  srv, err := CompiledFileServerFS(os.DirFS(dst))
+  check(t, err)
+  hsrv := httptest.NewServer(srv)
+  defer hsrv.Close()
+
+  resp, err := identityClient.Get(hsrv.URL + "/foo/foo.js")
+  check(t, err)
+  tag := ValidateHeaders(t, resp, "bar1", "")
+  resp, err = identityClient.Get(hsrv.URL + "/foo/foo-" + tag + ".js")
+  check(t, err)
+  ValidateHeaders(t, resp, "bar1", tag)
+
+  req, err := http.NewRequest("GET", hsrv.URL + "/foo.css", nil)
+  check(t, err)
+  req.Header.Set("Accept-Encoding", "gzip")
+  resp, err = identityClient.Do(req)
+  check(t, err)
+  testEq(t, resp.Header.Get("Content-Encoding"), "gzip")
+  input, err := gzip.NewReader(resp.Body)
+  check(t, err)
+  s, err := ioutil.ReadAll(input)
+  check(t, err)
+  testEq(t, string(s), "bar2")
+}
+
+func TestCompileSourceMaps(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "foo.js", "bar1")
+
+  srv.Config().SourceMaps = true
+  check(t, srv.Compile(dst))
+  csrv, err := CompiledFileServer(dst)
+  check(t, err)
+  asset, err := csrv.Asset("foo.js")
+  check(t, err)
+  _, err = os.Stat(dst + "/foo-" + asset.Digest() + ".js.map")
+  check(t, err)
+
+  hsrv := httptest.NewServer(csrv)
+  defer hsrv.Close()
+  resp, err := identityClient.Get(hsrv.URL + "/foo-" + asset.Digest() +
+                                  ".js.map")
+  check(t, err)
+  s, err := ioutil.ReadAll(resp.Body)
+  check(t, err)
+  if !strings.Contains(string(s), `"sources":["/foo.js"]`) {
+    t.Errorf("wrong source map:\n%s", string(s))
+  }
+}
+
+func TestCompiledServerSourceMapManifest(t *testing.T) {
+  /* old manifests don't say which maps there are, so they're looked for */
+  v1, err := CompiledFileServerFS(fstest.MapFS{
+    "manifest.json": &fstest.MapFile{Data: []byte(`{"foo.js":"abc"}`)},
+    "foo.js": &fstest.MapFile{Data: []byte("foo")},
+    "foo.js.map": &fstest.MapFile{Data: []byte("{}")},
+  })
+  check(t, err)
+  testEq(t, v1.(*compiledServer).precompiled["foo.js"].mappath, "foo.js.map")
+
+  /* but newer ones do, so only those are used */
+  v2, err := CompiledFileServerFS(fstest.MapFS{
+    "manifest.json": &fstest.MapFile{Data: []byte(`{"version":2,
+      "assets":{"foo.js":{"digest":"abc","file":"foo-abc.js"},
+                "bar.js":{"digest":"def","file":"bar-def.js",
+                          "source_map":"bar-def.js.map"}}}`)},
+    "foo-abc.js.map": &fstest.MapFile{Data: []byte("{}")},
+  })
+  check(t, err)
+  testEq(t, v2.(*compiledServer).precompiled["foo.js"].mappath, "")
+  testEq(t, v2.(*compiledServer).precompiled["bar.js"].mappath,
+         "bar-def.js.map")
+}
+
+func TestCompileCycle(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "a.js", "//= require b\na")
+  stubFile(t, wd, "b.js", "//= require a\nb")
+
+  err = srv.Compile(dst)
+  if _, ok := err.(*CycleError); !ok {
+    t.Errorf("expected a cycle error, got %v", err)
+  }
+}
+
+func TestCompilePaths(t *testing.T) {
+  srv, wd := stubPathsServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+
+  check(t, srv.Compile(dst))
+  for file, contents := range map[string]string{"foo.js": "app-foo",
+                                                "jquery.js": "jq",
+                                                "lib/a.js": "a"} {
+    s, err := ioutil.ReadFile(filepath.Join(dst, file))
+    check(t, err)
+    testEq(t, string(s), contents)
+  }
+}
+
+func TestCompileStackedExtensions(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "css/app.css.up.tmpl", "{{name}}")
+
+  check(t, srv.Compile(dst))
+  s, err := ioutil.ReadFile(filepath.Join(dst, "css/app.css"))
+  check(t, err)
+  testEq(t, string(s), "PASTE")
+}
+
+func TestContextServer(t *testing.T) {
+  srv, wd := stubCompiledServer(t)
+  defer os.RemoveAll(wd)
+  if _, ok := Server(srv).(ContextServer); !ok {
+    t.Errorf("compiled servers should take contexts")
+  }
+  if _, ok := FileServer(Config{Root: wd}).(ContextServer); !ok {
+    t.Errorf("file servers should take contexts")
+  }
+}
+
+func TestCompileCancelled(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "foo.js", "a")
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  if _, err = srv.CompileContext(ctx, dst); err != context.Canceled {
+    t.Errorf("expected compiling to be cancelled, got %v", err)
+  }
+  if _, err = os.Stat(filepath.Join(dst, "manifest.json")); err == nil {
+    t.Errorf("no manifest should be written when cancelled")
+  }
+}
+
+func TestCompileDigestConfig(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  srv.config.DigestHash = crypto.SHA256
+  srv.config.DigestLength = 12
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "foo.js", "bar")
+  stubFile(t, wd, "foo.png", "bar")
+
+  asset, err := srv.Asset("foo.js")
+  check(t, err)
+  static, err := srv.Asset("foo.png")
+  check(t, err)
+  sum := sha256.Sum256([]byte(Version + "bar"))
+  testEq(t, static.Digest(), hex.EncodeToString(sum[:])[:12])
+  if len(asset.Digest()) != 12 {
+    t.Errorf("wrong digest length: %s", asset.Digest())
+  }
+
+  check(t, srv.Compile(dst))
+  bits, err := ioutil.ReadFile(filepath.Join(dst, "manifest.json"))
+  check(t, err)
+  m, err := readManifest(bytes.NewReader(bits))
+  check(t, err)
+  testEq(t, m.DigestHash, "SHA-256")
+  if m.DigestLength != 12 {
+    t.Errorf("wrong digest length in the manifest: %d", m.DigestLength)
+  }
+
+  /* the compiled server finds digests of the same length */
+  csrv, err := CompiledFileServer(dst)
+  check(t, err)
+  path, err := csrv.AssetPath("foo.js")
+  check(t, err)
+  testEq(t, path, "/foo-" + asset.Digest() + ".js")
+  hsrv := httptest.NewServer(csrv)
+  defer hsrv.Close()
+  resp, err := identityClient.Get(hsrv.URL + path)
+  check(t, err)
+  ValidateHeaders(t, resp, "bar", asset.Digest())
+}
+
+func TestDigestHashUnavailable(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  srv.config.DigestHash = crypto.BLAKE2b_256
+  stubFile(t, wd, "foo.png", "bar")
+  if _, err := srv.Asset("foo.png"); err == nil {
+    t.Errorf("blake2b shouldn't be available without importing it")
+  }
+}
+
+func TestCompileCSSLinks(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "img/logo.png", "logo")
+  stubFile(t, wd, "css/app.css", ".a { background: url(../img/logo.png) }")
+
+  check(t, srv.Compile(dst))
+  logo, err := srv.Asset("img/logo.png")
+  check(t, err)
+  bits, err := ioutil.ReadFile(filepath.Join(dst, "css/app.css"))
+  check(t, err)
+  testEq(t, string(bits),
+         ".a { background: url(../img/logo-" + logo.Digest() + ".png) }")
+  _, err = os.Stat(filepath.Join(dst, "img/logo-" + logo.Digest() + ".png"))
+  check(t, err)
+}
+
+func TestCompilePrecompile(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "img/logo.png", "logo")
+  stubFile(t, wd, "img/unused.png", "unused")
+  stubFile(t, wd, "css/app.css", ".a { background: url(../img/logo.png) }")
+  stubFile(t, wd, "css/_broken.css", "/*= require ./missing */")
+  stubFile(t, wd, "admin/foo.js", "foo")
+  stubFile(t, wd, "admin/lib/bar.js", "bar")
+  srv.config.Precompile = []string{"app.css", "admin/*.js"}
+
+  check(t, srv.Compile(dst))
+  bits, err := ioutil.ReadFile(filepath.Join(dst, "manifest.json"))
+  check(t, err)
+  m, err := readManifest(bytes.NewReader(bits))
+  check(t, err)
+  for _, logical := range []string{"/css/app.css", "/img/logo.png",
+                                   "/admin/foo.js"} {
+    if m.Assets[logical] == nil {
+      t.Errorf("%s wasn't compiled", logical)
+    }
+  }
+  for _, logical := range []string{"/img/unused.png", "/css/_broken.css",
+                                   "/admin/lib/bar.js"} {
+    if m.Assets[logical] != nil {
+      t.Errorf("%s shouldn't have been compiled", logical)
+    }
+  }
+  _, err = os.Stat(filepath.Join(dst, "img/unused.png"))
+  if !os.IsNotExist(err) {
+    t.Errorf("unused image was written: %v", err)
+  }
+
+  srv.config.Precompile = []string{"["}
+  if srv.Compile(dst) == nil {
+    t.Errorf("bad pattern should be an error")
+  }
+}
+
+func TestCompileManifest(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "img/logo.png", "logo")
+  stubFile(t, wd, "css/lib.css", "lib")
+  stubFile(t, wd, "css/app.css",
+           "/*= require ./lib */\n.a { background: url(../img/logo.png) }")
+  mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+  for _, file := range []string{"img/logo.png", "css/lib.css", "css/app.css"} {
+    check(t, os.Chtimes(filepath.Join(wd, file), mtime, mtime))
+  }
+
+  check(t, srv.Compile(dst))
+  bits, err := ioutil.ReadFile(filepath.Join(dst, "manifest.json"))
+  check(t, err)
+  m, err := readManifest(bytes.NewReader(bits))
+  check(t, err)
+  if m.Version != manifestVersion {
+    t.Errorf("wrong version: %d", m.Version)
+  }
+
+  asset, err := srv.Asset("css/app.css")
+  check(t, err)
+  entry := m.Assets["/css/app.css"]
+  testEq(t, entry.File, "css/app-" + asset.Digest() + ".css")
+  stat, err := os.Stat(filepath.Join(dst, entry.File))
+  check(t, err)
+  if entry.Size != stat.Size() {
+    t.Errorf("wrong size: %d", entry.Size)
+  }
+  if !entry.ModTime.Equal(mtime) {
+    t.Errorf("wrong mtime: %v", entry.ModTime)
+  }
+  testEq(t, entry.ContentType, "text/css; charset=utf-8")
+  testEq(t, strings.Join(entry.Dependencies, " "), "/css/lib.css /img/logo.png")
+  gz, ok := entry.Encodings["gzip"]
+  if !ok {
+    t.Fatalf("no gzip encoding in the manifest")
+  }
+  testEq(t, gz.File, entry.File + ".gz")
+  stat, err = os.Stat(filepath.Join(dst, gz.File))
+  check(t, err)
+  if gz.Size != stat.Size() {
+    t.Errorf("wrong gzip size: %d", gz.Size)
+  }
+
+  /* the compiled server knows all of this without looking at the files */
+  csrv, err := CompiledFileServer(dst)
+  check(t, err)
+  compiled, err := csrv.Asset("css/app.css")
+  check(t, err)
+  if !compiled.ModTime().Equal(mtime) {
+    t.Errorf("wrong mtime from the compiled server: %v", compiled.ModTime())
+  }
+}
+
+func TestCompileIncremental(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "a.js", "a")
+  stubFile(t, wd, "b.js", "b")
+  stubFile(t, wd, "c.png", "c")
+
+  expect := func(list []string, expected string) {
+    testEq(t, strings.Join(list, " "), expected)
+  }
+  report, err := srv.CompileContext(context.Background(), dst)
+  check(t, err)
+  expect(report.Added, "/a.js /b.js /c.png")
+  expect(report.Unchanged, "")
+
+  /* nothing is written again if nothing changed */
+  past := time.Now().Add(-time.Hour)
+  check(t, os.Chtimes(filepath.Join(dst, "a.js"), past, past))
+  report, err = srv.CompileContext(context.Background(), dst)
+  check(t, err)
+  expect(report.Added, "")
+  expect(report.Changed, "")
+  expect(report.Unchanged, "/a.js /b.js /c.png")
+  stat, err := os.Stat(filepath.Join(dst, "a.js"))
+  check(t, err)
+  if !stat.ModTime().Equal(past) {
+    t.Errorf("a.js shouldn't have been written again")
+  }
+
+  stubFile(t, wd, "a.js", "a2")
+  stubFile(t, wd, "d.js", "d")
+  check(t, os.Remove(filepath.Join(wd, "b.js")))
+  check(t, os.Remove(filepath.Join(dst, "c.png.gz")))
+  report, err = srv.CompileContext(context.Background(), dst)
+  check(t, err)
+  expect(report.Added, "/d.js")
+  expect(report.Changed, "/a.js")
+  expect(report.Rewritten, "/c.png")
+  expect(report.Removed, "/b.js")
+  expect(report.Unchanged, "")
+
+  bits, err := ioutil.ReadFile(filepath.Join(dst, "a.js"))
+  check(t, err)
+  testEq(t, string(bits), "a2")
+  _, err = os.Stat(filepath.Join(dst, "c.png.gz"))
+  check(t, err)
+}
+
+func TestCompileSkipsBuilding(t *testing.T) {
+  _, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "app.js.tmpl", "app")
+  stubFile(t, wd, "bundle.js", "//= require_tree ./lib")
+  stubFile(t, wd, "lib/a.js", "a")
+
+  var built int32
+  registry := NewRegistry()
+  check(t, registry.RegisterStreamProcessor(StreamProcessorFunc(
+    func(ctx context.Context, r io.Reader, w io.Writer, info AssetInfo) error {
+      atomic.AddInt32(&built, 1)
+      _, err := io.Copy(w, r)
+      return err
+    }), ".tmpl"))
+
+  /* each compile is by a new server, like separate deploys would be */
+  compile := func() *CompileReport {
+    srv := FileServer(Config{Root: wd, Registry: registry}).(*fileServer)
+    report, err := srv.CompileContext(context.Background(), dst)
+    check(t, err)
+    return report
+  }
+  expect := func(list []string, expected string) {
+    testEq(t, strings.Join(list, " "), expected)
+  }
+  builds := func(expected int32) {
+    if n := atomic.LoadInt32(&built); n != expected {
+      t.Errorf("app.js was built %d times, expected %d", n, expected)
+    }
+  }
+  expect(compile().Added, "/app.js /bundle.js /lib/a.js")
+  builds(1)
+
+  /* unchanged sources aren't processed again */
+  report := compile()
+  expect(report.Unchanged, "/app.js /bundle.js /lib/a.js")
+  builds(1)
+
+  /* missing or modified encoded copies are written again */
+  check(t, ioutil.WriteFile(filepath.Join(dst, "app.js.gz"), nil, 0644))
+  report = compile()
+  expect(report.Changed, "")
+  expect(report.Rewritten, "/app.js")
+  builds(2)
+  file, err := os.Open(filepath.Join(dst, "app.js.gz"))
+  check(t, err)
+  defer file.Close()
+  input, err := gzip.NewReader(file)
+  check(t, err)
+  bits, err := ioutil.ReadAll(input)
+  check(t, err)
+  testEq(t, string(bits), "app")
+
+  /* files added to required directories are noticed */
+  stubFile(t, wd, "lib/b.js", "b")
+  report = compile()
+  expect(report.Added, "/lib/b.js")
+  expect(report.Changed, "/bundle.js")
+  expect(report.Unchanged, "/app.js /lib/a.js")
+}
@@ -0,0 +1,122 @@
+package paste
+
+import "context"
+import "path"
+import "regexp"
+import "strings"
+
+// Matches url() references in stylesheets, with the reference itself in one
+// of the groups depending on how it's quoted
+var cssURLRegex = regexp.MustCompile(
+  `url\(\s*(?:"([^"]*)"|'([^']*)'|([^'"()\s]*))\s*\)`)
+
+// Parses a url() reference in the stylesheet with the given logical name,
+// returning the logical name of the asset it refers to and anything after the
+// path, like a query string or fragment. References which aren't to other
+// assets, like absolute URLs, 'data:' URLs and fragments, aren't returned.
+//
+// References to other stylesheets, like '@import url(x.css)', aren't returned
+// either and so stay undigested. A stylesheet's digest covers the digests of
+// everything it refers to, so stylesheets which import each other would have
+// no digest at all. Stylesheets should be bundled with require instead.
+func cssReference(stylesheet, ref string) (string, string, bool) {
+  if ref == "" || strings.HasPrefix(ref, "/") || strings.HasPrefix(ref, "#") ||
+     strings.Contains(ref, ":") {
+    return "", "", false
+  }
+  suffix := ""
+  if i := strings.IndexAny(ref, "?#"); i >= 0 {
+    ref, suffix = ref[:i], ref[i:]
+  }
+  logical := path.Join("/", path.Dir(stylesheet), ref)
+  if path.Ext(logical) == ".css" {
+    return "", "", false
+  }
+  return logical, suffix, true
+}
+
+// Returns the path to a logical name relative to a logical directory
+func relativePath(dir, logical string) string {
+  from := strings.Split(strings.Trim(path.Clean(dir), "/"), "/")
+  to := strings.Split(strings.TrimPrefix(path.Clean(logical), "/"), "/")
+  if from[0] == "" {
+    from = nil
+  }
+  i := 0
+  for i < len(from) && i < len(to) - 1 && from[i] == to[i] {
+    i++
+  }
+  parts := make([]string, 0)
+  for range from[i:] {
+    parts = append(parts, "..")
+  }
+  return strings.Join(append(parts, to[i:]...), "/")
+}
+
+// Calls 'f' for every url() in a stylesheet which refers to another asset,
+// replacing the reference with what 'f' returns
+func replaceURLs(stylesheet, body string,
+                 f func(logical, suffix string) string) string {
+  return cssURLRegex.ReplaceAllStringFunc(body, func(match string) string {
+    groups := cssURLRegex.FindStringSubmatch(match)
+    quote, ref := "", groups[3]
+    if groups[1] != "" {
+      quote, ref = `"`, groups[1]
+    } else if groups[2] != "" {
+      quote, ref = `'`, groups[2]
+    }
+    logical, suffix, ok := cssReference(stylesheet, ref)
+    if !ok {
+      return match
+    }
+    replacement := f(logical, suffix)
+    if replacement == "" {
+      return match
+    }
+    return "url(" + quote + replacement + quote + ")"
+  })
+}
+
+// Finds all assets referenced through url() in every part of this bundle,
+// recording them as links. References which can't be found are left alone.
+func (s *processedAsset) findLinks(ctx context.Context) error {
+  s.linked = make(map[string]Asset)
+  for _, a := range s.flattened {
+    stylesheet := path.Join("/", a.LogicalName())
+    body := s.segment(a)
+    var err error
+    replaceURLs(stylesheet, body, func(logical, suffix string) string {
+      if _, ok := s.linked[logical]; ok || err != nil {
+        return ""
+      }
+      link, e := s.static.srv.AssetContext(ctx, logical)
+      if e == nil {
+        s.linked[logical] = link
+        s.links = append(s.links, link)
+      } else if ctx.Err() != nil {
+        err = ctx.Err()
+      }
+      return ""
+    })
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+// Rewrites the url() references of one part of this bundle to point at the
+// digested names of the linked assets, relative to where the bundle is
+func (s *processedAsset) rewriteURLs(a Asset, body string) string {
+  stylesheet := path.Join("/", a.LogicalName())
+  dir := path.Dir(path.Join("/", s.static.logical))
+  return replaceURLs(stylesheet, body, func(logical, suffix string) string {
+    link, ok := s.linked[logical]
+    if !ok {
+      return ""
+    }
+    ext := path.Ext(logical)
+    digested := logical[:len(logical) - len(ext)] + "-" + link.Digest() + ext
+    return relativePath(dir, digested) + suffix
+  })
+}
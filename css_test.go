@@ -0,0 +1,102 @@
+package paste
+
+import "encoding/json"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func TestCSSReference(t *testing.T) {
+  check := func(ref, logical, suffix string) {
+    l, s, ok := cssReference("/css/app.css", ref)
+    if !ok {
+      l, s = "", ""
+    }
+    testEq(t, l, logical)
+    testEq(t, s, suffix)
+  }
+  check("logo.png", "/css/logo.png", "")
+  check("../img/logo.png", "/img/logo.png", "")
+  check("fonts/a.woff?#iefix", "/css/fonts/a.woff", "?#iefix")
+  check("sprite.svg#icon", "/css/sprite.svg", "#icon")
+  check("/img/logo.png", "", "")
+  check("http://example.com/logo.png", "", "")
+  check("//example.com/logo.png", "", "")
+  check("data:image/png;base64,AAAA", "", "")
+  check("#filter", "", "")
+  check("other.css", "", "")
+}
+
+func TestRelativePath(t *testing.T) {
+  testEq(t, relativePath("/", "/img/a.png"), "img/a.png")
+  testEq(t, relativePath("/css", "/css/a.png"), "a.png")
+  testEq(t, relativePath("/css", "/img/a.png"), "../img/a.png")
+  testEq(t, relativePath("/css/a/b", "/css/img/a.png"), "../../img/a.png")
+  testEq(t, relativePath("/css", "/a.png"), "../a.png")
+}
+
+func TestCSSRewritesURLs(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "img/logo.png", "logo")
+  stubFile(t, wd, "css/fonts/a.woff", "font")
+  stubFile(t, wd, "css/vendor/lib.css",
+           ".b { background: url('../../img/logo.png') }")
+  stubFile(t, wd, "css/app.css", `/*= require ./vendor/lib */
+.a { background: url(../img/logo.png) }
+@font-face { src: url("fonts/a.woff?#iefix") }
+.c { background: url(data:image/png;base64,AAAA) url(missing.png) }`)
+
+  logo, err := srv.Asset("img/logo.png")
+  check(t, err)
+  font, err := srv.Asset("css/fonts/a.woff")
+  check(t, err)
+  asset, err := srv.Asset("css/app.css")
+  check(t, err)
+  bits, err := ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), `.b { background: url('../img/logo-` + logo.Digest() + `.png') }
+/*= require ./vendor/lib */
+.a { background: url(../img/logo-` + logo.Digest() + `.png) }
+@font-face { src: url("fonts/a-` + font.Digest() + `.woff?#iefix") }
+.c { background: url(data:image/png;base64,AAAA) url(missing.png) }`)
+
+  /* changing an image changes the stylesheet */
+  digest := asset.Digest()
+  if asset.Stale() {
+    t.Errorf("shouldn't be stale yet")
+  }
+  logoPath := filepath.Join(wd, "img/logo.png")
+  future := time.Now().Add(5 * time.Second)
+  check(t, ioutil.WriteFile(logoPath, []byte("new logo"), 0644))
+  check(t, os.Chtimes(logoPath, future, future))
+  if !asset.Stale() {
+    t.Errorf("should be stale after the image changed")
+  }
+  rebuilt, err := srv.Asset("css/app.css")
+  check(t, err)
+  if rebuilt.Digest() == digest {
+    t.Errorf("digest should change along with the image")
+  }
+}
+
+func TestCSSSourceMapOriginal(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  srv.config.SourceMaps = true
+  src := ".a { background: url(../img/logo.png) }"
+  stubFile(t, wd, "img/logo.png", "logo")
+  stubFile(t, wd, "css/app.css", src)
+
+  asset, err := srv.Asset("css/app.css")
+  check(t, err)
+  bits, err := ioutil.ReadFile(unwrap(asset).(mappedAsset).sourceMap())
+  check(t, err)
+  var decoded struct {
+    SourcesContent []string
+  }
+  check(t, json.Unmarshal(bits, &decoded))
+  /* devtools show the file as it is, not as it was rewritten */
+  testEq(t, decoded.SourcesContent[0], src)
+}
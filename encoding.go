@@ -0,0 +1,153 @@
+package paste
+
+import "compress/gzip"
+import "io"
+import "net/http"
+import "strconv"
+import "strings"
+
+// An encoder applies a content-coding, like gzip, to the compiled version of
+// an asset. Given the writer for the encoded file, it returns a writer which the
+// contents of the asset are written to. Closing the returned writer must flush
+// all encoded output, but it must not close the underlying writer.
+type Encoder interface {
+  Encode(w io.Writer) (io.WriteCloser, error)
+}
+
+// Easy way of implementing an encoder as just a function
+type EncoderFunc func(w io.Writer) (io.WriteCloser, error)
+
+type encoding struct {
+  name    string  // content-coding, as in the Content-Encoding header
+  ext     string  // extension appended to the encoded version of a file
+  encoder Encoder
+}
+
+// A file containing an encoded version of an asset's contents
+type encodedFile struct {
+  encoding string
+  path     string
+  size     int64
+}
+
+// Implemented by assets which have encoded copies of their contents available
+// on the filesystem.
+type encodedAsset interface {
+  encoded() []encodedFile
+}
+
+// All known content-codings. Compiled servers look for files of all of these
+// whether or not an encoder is registered, so production binaries don't need
+// to import the encoder packages.
+var encodings = []*encoding{
+  &encoding{ name: "gzip", ext: ".gz", encoder: EncoderFunc(gzipEncode) },
+  &encoding{ name: "br", ext: ".br" },
+  &encoding{ name: "zstd", ext: ".zst" },
+}
+
+// Registers an encoder for the given content-coding. Whenever assets are
+// compiled, an extra copy of each file is written with the extension 'ext'
+// appended, encoded with 'e'. It is considered an error to register more than
+// one encoder for a content-coding and this function will panic as a result.
+//
+// Example:
+//
+//    import "github.com/alexcrichton/go-paste"
+//
+//    func init() {
+//      paste.RegisterEncoding(paste.EncoderFunc(deflate), "deflate", ".zz")
+//    }
+//
+//    func deflate(w io.Writer) (io.WriteCloser, error) {
+//      return flate.NewWriter(w, flate.BestCompression)
+//    }
+func RegisterEncoding(e Encoder, name, ext string) {
+  for _, enc := range encodings {
+    if enc.name != name {
+      continue
+    }
+    if enc.encoder != nil {
+      panic("Encoder already registered for " + name)
+    }
+    enc.ext = ext
+    enc.encoder = e
+    return
+  }
+  encodings = append(encodings, &encoding{ name: name, ext: ext, encoder: e })
+}
+
+func (e EncoderFunc) Encode(w io.Writer) (io.WriteCloser, error) {
+  return e(w)
+}
+
+func gzipEncode(w io.Writer) (io.WriteCloser, error) {
+  return gzip.NewWriterLevel(w, gzip.BestCompression)
+}
+
+// Returns the encodings which should be generated when compiling, taking into
+// account the configuration of which ones are enabled
+func (c *Config) enabledEncodings() []*encoding {
+  ret := make([]*encoding, 0)
+  for _, enc := range encodings {
+    if enc.encoder == nil {
+      continue
+    }
+    enabled := c.Encodings == nil
+    for _, name := range c.Encodings {
+      if name == enc.name {
+        enabled = true
+      }
+    }
+    if enabled {
+      ret = append(ret, enc)
+    }
+  }
+  return ret
+}
+
+// Picks which of the encoded files should be served for a request. The client's
+// preference wins, and among equally preferred encodings the smallest file is
+// chosen. Returns nil if the client doesn't accept any of them.
+func negotiateEncoding(r *http.Request, files []encodedFile) *encodedFile {
+  var best *encodedFile
+  bestq := 0.0
+  for i := range files {
+    q := encodingQuality(r, files[i].encoding)
+    if q <= 0 || q < bestq {
+      continue
+    }
+    if best == nil || q > bestq || files[i].size < best.size {
+      best, bestq = &files[i], q
+    }
+  }
+  return best
+}
+
+// Returns the q-value the Accept-Encoding header of a request gives the
+// content-coding, taking into account wildcards. Zero means it isn't accepted.
+func encodingQuality(r *http.Request, encoding string) float64 {
+  accepted := 0.0
+  for _, header := range r.Header["Accept-Encoding"] {
+    for _, part := range strings.Split(header, ",") {
+      fields := strings.Split(part, ";")
+      name := strings.ToLower(strings.TrimSpace(fields[0]))
+      if name != encoding && name != "*" {
+        continue
+      }
+      q := 1.0
+      for _, param := range fields[1:] {
+        param = strings.TrimSpace(param)
+        if strings.HasPrefix(param, "q=") {
+          f, err := strconv.ParseFloat(param[2:], 64)
+          if err == nil { q = f }
+        }
+      }
+      /* An explicit mention of the encoding beats the wildcard */
+      if name == encoding {
+        return q
+      }
+      accepted = q
+    }
+  }
+  return accepted
+}
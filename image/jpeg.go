@@ -1,19 +1,20 @@
 package image
 
+import "context"
 import "os/exec"
 import "github.com/alexcrichton/go-paste"
 
 func init() {
   if hascmd("jpegoptim", "-V") {
-    paste.RegisterCompressor(paste.ProcessorFunc(jpegoptim), ".jpg")
-    paste.RegisterCompressor(paste.ProcessorFunc(jpegoptim), ".jpeg")
+    paste.RegisterCompressor(paste.ContextProcessorFunc(jpegoptim), ".jpg")
+    paste.RegisterCompressor(paste.ContextProcessorFunc(jpegoptim), ".jpeg")
   }
 }
 
-func jpegoptim(infile, outfile string) error {
+func jpegoptim(ctx context.Context, infile, outfile string) error {
   err := cp(infile, outfile)
   if err != nil {
     return err
   }
-  return exec.Command("jpegoptim", "--strip-all", outfile).Run()
+  return exec.CommandContext(ctx, "jpegoptim", "--strip-all", outfile).Run()
 }
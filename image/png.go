@@ -1,23 +1,25 @@
 package image
 
+import "context"
 import "os/exec"
 import "github.com/alexcrichton/go-paste"
 
 func init() {
   if hascmd("optipng") {
-    paste.RegisterCompressor(paste.ProcessorFunc(optipng), ".png")
-    paste.RegisterCompressor(paste.ProcessorFunc(optipng), ".gif")
-    paste.RegisterCompressor(paste.ProcessorFunc(optipng), ".bmp")
-    paste.RegisterCompressor(paste.ProcessorFunc(optipng), ".tiff")
+    paste.RegisterCompressor(paste.ContextProcessorFunc(optipng), ".png")
+    paste.RegisterCompressor(paste.ContextProcessorFunc(optipng), ".gif")
+    paste.RegisterCompressor(paste.ContextProcessorFunc(optipng), ".bmp")
+    paste.RegisterCompressor(paste.ContextProcessorFunc(optipng), ".tiff")
   } else if hascmd("pngcrush", "-h") {
-    paste.RegisterCompressor(paste.ProcessorFunc(pngcrush), ".png")
+    paste.RegisterCompressor(paste.ContextProcessorFunc(pngcrush), ".png")
   }
 }
 
-func optipng(infile, outfile string) error {
-  return exec.Command("optipng", "-clobber", "-out", outfile, infile).Run()
+func optipng(ctx context.Context, infile, outfile string) error {
+  return exec.CommandContext(ctx, "optipng", "-clobber", "-out", outfile,
+                             infile).Run()
 }
 
-func pngcrush(infile, outfile string) error {
-  return exec.Command("pngcrush", "-ow", infile, outfile).Run()
+func pngcrush(ctx context.Context, infile, outfile string) error {
+  return exec.CommandContext(ctx, "pngcrush", "-ow", infile, outfile).Run()
 }
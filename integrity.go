@@ -0,0 +1,64 @@
+package paste
+
+import "crypto"
+import _ "crypto/sha256"
+import _ "crypto/sha512"
+import "encoding/base64"
+import "errors"
+import "fmt"
+import "io"
+
+// Names of the hashes which browsers support for subresource integrity
+var integrityNames = map[crypto.Hash]string{
+  crypto.SHA256: "sha256",
+  crypto.SHA384: "sha384",
+  crypto.SHA512: "sha512",
+}
+
+// Returns the hash which integrity values should be computed with
+func (c *Config) integrityHash() (crypto.Hash, error) {
+  if c.Integrity == 0 {
+    return crypto.SHA384, nil
+  }
+  if _, ok := integrityNames[c.Integrity]; !ok {
+    return 0, errors.New(fmt.Sprintf("unsupported integrity hash: %v",
+                                     c.Integrity))
+  }
+  return c.Integrity, nil
+}
+
+// Formats the sum of a hash as the value of an 'integrity' attribute
+func formatIntegrity(h crypto.Hash, sum []byte) string {
+  return integrityNames[h] + "-" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// Computes the integrity value of the served contents of an asset
+func assetIntegrity(h crypto.Hash, a Asset) (string, error) {
+  f, err := openAsset(a, a.Pathname())
+  if err != nil { return "", err }
+  defer f.Close()
+  hash := h.New()
+  if _, err = io.Copy(hash, f); err != nil {
+    return "", err
+  }
+  return formatIntegrity(h, hash.Sum(nil)), nil
+}
+
+func (s *fileServer) Integrity(logical string) (string, error) {
+  h, err := s.config.integrityHash()
+  if err != nil { return "", err }
+  asset, err := s.Asset(logical)
+  if err != nil { return "", err }
+  return assetIntegrity(h, asset)
+}
+
+func (s *compiledServer) Integrity(logical string) (string, error) {
+  asset, err := s.Asset(logical)
+  if err != nil { return "", err }
+  integrity := asset.(*precompiledAsset).integrity
+  if integrity == "" {
+    return "", errors.New("no integrity recorded for " + logical +
+                          ", it needs to be compiled again")
+  }
+  return integrity, nil
+}
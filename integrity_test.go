@@ -0,0 +1,72 @@
+package paste
+
+import "crypto"
+import "crypto/sha256"
+import "crypto/sha512"
+import "encoding/base64"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "testing"
+
+func TestIntegrity(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "foo.js", "bar")
+
+  sum384 := sha512.Sum384([]byte("bar"))
+  integrity, err := srv.Integrity("foo.js")
+  check(t, err)
+  testEq(t, integrity,
+         "sha384-" + base64.StdEncoding.EncodeToString(sum384[:]))
+
+  srv.Config().Integrity = crypto.SHA256
+  sum256 := sha256.Sum256([]byte("bar"))
+  integrity, err = srv.Integrity("foo.js")
+  check(t, err)
+  testEq(t, integrity,
+         "sha256-" + base64.StdEncoding.EncodeToString(sum256[:]))
+
+  srv.Config().Integrity = crypto.MD5
+  if _, err = srv.Integrity("foo.js"); err == nil {
+    t.Errorf("md5 isn't allowed for integrity")
+  }
+}
+
+func TestCompiledIntegrity(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, wd, "foo/foo.js", "bar")
+
+  check(t, srv.Compile(dst))
+  expected, err := srv.Integrity("foo/foo.js")
+  check(t, err)
+
+  /* the compiled server doesn't need anything but the manifest */
+  csrv, err := CompiledFileServer(dst)
+  check(t, err)
+  check(t, os.Remove(filepath.Join(dst, "foo/foo.js")))
+  integrity, err := csrv.Integrity("foo/foo.js")
+  check(t, err)
+  testEq(t, integrity, expected)
+}
+
+func TestCompiledLegacyManifest(t *testing.T) {
+  dst, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(dst)
+  stubFile(t, dst, "foo.js", "bar")
+  stubFile(t, dst, "manifest.json", `{"/foo.js": "abcd"}`)
+
+  srv, err := CompiledFileServer(dst)
+  check(t, err)
+  path, err := srv.AssetPath("foo.js")
+  check(t, err)
+  testEq(t, path, "/foo-abcd.js")
+  if _, err = srv.Integrity("foo.js"); err == nil {
+    t.Errorf("old manifests don't have integrity values")
+  }
+}
@@ -5,22 +5,16 @@
 package jsmin
 
 import "bitbucket.org/maxhauser/jsmin"
+import "context"
 import "github.com/alexcrichton/go-paste"
-import "os"
+import "io"
 
 func init() {
-  paste.RegisterCompressor(paste.ProcessorFunc(minify), ".js")
+  paste.RegisterStreamCompressor(paste.StreamProcessorFunc(minify), ".js")
 }
 
-func minify(infile, outfile string) error {
-  in, err := os.Open(infile)
-  if err != nil { return err }
-  defer in.Close()
-
-  out, err := os.Create(outfile)
-  if err != nil { return err }
-  defer out.Close()
-
-  jsmin.Run(in, out)
+func minify(ctx context.Context, r io.Reader, w io.Writer,
+            info paste.AssetInfo) error {
+  jsmin.Run(r, w)
   return nil
 }
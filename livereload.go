@@ -0,0 +1,195 @@
+package paste
+
+import "fmt"
+import "net/http"
+import "strings"
+import "sync"
+import "time"
+
+// Prefix of all URLs which the file server handles itself instead of serving
+// up assets
+const livereloadPrefix = "/__paste/"
+
+// Script served to browsers to reload the page whenever an asset is rebuilt.
+// Stylesheets are swapped out in place instead of reloading everything.
+const livereloadScript = `(function() {
+  var script = document.currentScript;
+  var base = script ? script.src.replace(/__paste\/livereload\.js.*$/, "")
+                    : "/";
+  var events = new EventSource(base + "__paste/events");
+
+  function logical(href) {
+    var a = document.createElement("a");
+    a.href = href;
+    return a.pathname.replace(/-[0-9a-f]{8,}(\.\w+)$/, "$1");
+  }
+
+  function swap(name) {
+    var links = document.querySelectorAll("link[rel=stylesheet]");
+    var found = false;
+    for (var i = 0; i < links.length; i++) {
+      var link = links[i];
+      if (logical(link.href).slice(-name.length) !== name) {
+        continue;
+      }
+      found = true;
+      var fresh = link.cloneNode();
+      fresh.href = link.href.replace(/[?#].*$/, "") + "?paste=" + Date.now();
+      fresh.onload = function(old) {
+        return function() { old.parentNode && old.parentNode.removeChild(old); };
+      }(link);
+      link.parentNode.insertBefore(fresh, link.nextSibling);
+    }
+    return found;
+  }
+
+  events.onmessage = function(e) {
+    var name = e.data;
+    if (!/\.css$/.test(name) || !swap(name)) {
+      window.location.reload();
+    }
+  };
+})();
+`
+
+// Keeps track of all browsers listening for assets being rebuilt, and rebuilds
+// assets whenever sources change so it can tell them
+type reloader struct {
+  srv     *fileServer
+  changes chan bool
+  done    chan bool
+  clients map[chan string]bool
+  closed  sync.Once
+  sync.Mutex
+}
+
+func newReloader(s *fileServer) *reloader {
+  r := &reloader{ srv: s, changes: make(chan bool, 1), done: make(chan bool),
+                  clients: make(map[chan string]bool) }
+  go r.run()
+  return r
+}
+
+// Signals that sources have changed, never blocking
+func (r *reloader) notify() {
+  select {
+  case r.changes <- true:
+  default:
+  }
+}
+
+func (r *reloader) run() {
+  for {
+    select {
+    case <-r.done:
+      return
+    case <-r.changes:
+    }
+    /* Editors tend to touch files a few times when saving, so wait for the
+       dust to settle */
+    time.Sleep(50 * time.Millisecond)
+    select {
+    case <-r.changes:
+    default:
+    }
+    for _, logical := range r.rebuild() {
+      r.broadcast(logical)
+    }
+  }
+}
+
+// Rebuilds every asset which has been built before, returning the logical
+// names of all those which changed (or which no longer build)
+func (r *reloader) rebuild() []string {
+  s := r.srv
+  s.Lock()
+  metas := make(map[string]*assetMeta)
+  for logical, meta := range s.assets {
+    metas[logical] = meta
+  }
+  s.Unlock()
+
+  changed := make([]string, 0)
+  for logical, meta := range metas {
+    meta.Lock()
+    digest := ""
+    if meta.Asset != nil {
+      digest = meta.Digest()
+    }
+    meta.Unlock()
+    if digest == "" {
+      continue
+    }
+    a, err := s.Asset(logical)
+    if err != nil || a.Digest() != digest {
+      changed = append(changed, logical)
+    }
+  }
+  return changed
+}
+
+func (r *reloader) broadcast(logical string) {
+  r.Lock()
+  defer r.Unlock()
+  for client := range r.clients {
+    select {
+    case client <- logical:
+    default:
+      /* don't let one slow browser hold up everyone else */
+    }
+  }
+}
+
+func (r *reloader) Close() error {
+  r.closed.Do(func() { close(r.done) })
+  return nil
+}
+
+// Handles the requests under livereloadPrefix
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+  switch strings.TrimPrefix(req.URL.Path, livereloadPrefix) {
+  case "livereload.js":
+    w.Header().Set("Content-Type", "application/javascript")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Write([]byte(livereloadScript))
+  case "events":
+    r.serveEvents(w, req)
+  default:
+    http.NotFound(w, req)
+  }
+}
+
+// Streams the logical names of rebuilt assets as server-sent events
+func (r *reloader) serveEvents(w http.ResponseWriter, req *http.Request) {
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+    return
+  }
+  client := make(chan string, 16)
+  r.Lock()
+  r.clients[client] = true
+  r.Unlock()
+  defer func() {
+    r.Lock()
+    delete(r.clients, client)
+    r.Unlock()
+  }()
+
+  headers := w.Header()
+  headers.Set("Content-Type", "text/event-stream")
+  headers.Set("Cache-Control", "no-cache")
+  fmt.Fprintf(w, "retry: 1000\n\n")
+  flusher.Flush()
+  for {
+    select {
+    case <-req.Context().Done():
+      return
+    case <-r.done:
+      return
+    case logical := <-client:
+      fmt.Fprintf(w, "data: %s\n\n", logical)
+      flusher.Flush()
+    }
+  }
+}
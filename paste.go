@@ -6,12 +6,19 @@
 // filters.
 package paste
 
+import "context"
+import "crypto"
+import "errors"
+import "io"
+import "io/fs"
+import "mime"
 import "net/http"
 import "os"
 import "path"
 import "path/filepath"
-import "regexp"
+import "strings"
 import "sync"
+import "sync/atomic"
 import "time"
 
 // Version string which is prepended to all hashes generated. This doesn't
@@ -19,13 +26,16 @@ import "time"
 // changes it forces all regenerated assets' hashes to change.
 const Version = "0.0.0"
 
-// Regex for finding the md5 hash in a requested filename (if any)
-var hashRegex = regexp.MustCompile(`(.*)-([a-f0-9]{32})(\.\w+)`)
-
 type assetMeta struct {
   err     error
   Asset
   sync.Mutex
+
+  /* When watching for changes, what the asset was built from (guarded by the
+     server's lock), and whether any of that may have changed since the asset
+     was last known to be up to date (accessed atomically) */
+  sources *assetSources
+  dirty   int32
 }
 
 // A paste Server instance is used to interact with the assets on the
@@ -48,29 +58,72 @@ type Server interface {
   //
   //    foo.js           - processed asset, initial filename
   //    foo.js.gz        - same as above but gzipped
-  //    foo-md5hash.js   - same as 'foo.js' but with the hash in the filename
-  //    foo-m5hash.js.gz - same as above but gzipped
+  //    foo-hash.js      - same as 'foo.js' but with the hash in the filename
+  //    foo-hash.js.gz   - same as above but gzipped
   //
   // The gzipped versions of files are generated for web servers which can serve
   // up a gzipped file by default instead of having to re-gzip all assets all
   // the time. All generated gzip files have the maximum compression enabled.
+  //
+  // Likewise, a copy is generated for every other registered encoding (see
+  // RegisterEncoding) which is enabled in the configuration.
   Compile(dst string) error
 
   // Fetches an Asset instance for a given logical path, returning any errors
   // encountered along the way
   Asset(logical string) (Asset, error)
 
+  // Returns the subresource integrity value of an asset, such as
+  // 'sha384-...', for the 'integrity' attribute of script and link tags. The
+  // hash is computed over the asset as it's served, with the hash given in the
+  // configuration.
+  Integrity(logical string) (string, error)
+
   // Returns the configuration of this server so it can be modified for all
   // future work the server does
   Config() *Config
 }
 
+// A server whose work can be cancelled through a context. The servers returned
+// by FileServer and CompiledFileServer both implement this.
+type ContextServer interface {
+  Server
+
+  // Same as Asset, except that building the asset is aborted with the
+  // context's error if the context is cancelled or its deadline passes. When
+  // serving requests, the request's context is used.
+  AssetContext(ctx context.Context, logical string) (Asset, error)
+
+  // Same as Compile, except that compiling is aborted with the context's error
+  // if the context is cancelled or its deadline passes.
+  //
+  // If 'dst' has been compiled into before, assets whose output is already
+  // there aren't written again. The returned report says what changed.
+  CompileContext(ctx context.Context, dst string) (*CompileReport, error)
+}
+
 // Version of a server which watches for file names and regenerates files as
 // necessary.
 type fileServer struct {
   assets map[string]*assetMeta
   config Config
   sync.Mutex
+
+  /* If watching for changes, this is bumped every time something changes */
+  watcher    watcher
+  generation uint64
+  reloader   *reloader
+
+  /* If watching for changes, directory listings by source name, all of which
+     were listed in the given generation */
+  listings           map[string]*dirListing
+  listingsGeneration uint64
+  listingsLock       sync.Mutex
+
+  /* Directory inside of TempDir which only this server builds files in,
+     created the first time it's needed */
+  tmpdir  string
+  tmpLock sync.Mutex
 }
 
 // Configuration for when creating a FileServer
@@ -82,11 +135,101 @@ type Config struct {
   // Location in the filesystem which all assets are to be derived from
   Root string
 
+  // Other locations to look for assets in, after Root, in order. If an asset
+  // is found in more than one location, the first one is used.
+  Paths []string
+
+  // Filesystem containing the assets, for example an embed.FS. If set, Root is
+  // a slash-separated directory within this filesystem instead of a directory
+  // on the OS filesystem, and an empty Root means the top of the filesystem.
+  // The same goes for Paths.
+  FS fs.FS
+
   // Flag if output should be compressed or not
   Compressed bool
 
-  // Location to put intermediate files when compiling
+  // Location to put intermediate files when compiling. This is always on the
+  // OS filesystem, and defaults to a directory inside of Root or, if FS is
+  // set, inside of the system's temporary directory. Nothing in it is ever
+  // served or compiled as an asset. Each server builds in a directory of its
+  // own inside of it, which is removed when the server is closed.
   TempDir string
+
+  // Globs as understood by path.Match of source files which are neither
+  // served, compiled, required nor watched, like "vendor/*" or "*.orig".
+  // Patterns without a slash match any file or directory by name, and others
+  // match paths relative to the root the file is in. Dotfiles and editor swap
+  // and backup files ('*.swp', '*~' and '#*#') are always ignored.
+  Ignore []string
+
+  // Flag if the filesystem should be watched for changes to sources. Normally
+  // every request for an asset checks whether it or any of its dependencies
+  // have changed, but when watching, assets are only checked after the OS
+  // reports that something changed (or after a periodic scan of all sources
+  // notices a change, if the OS can't report changes).
+  Watch bool
+
+  // Flag if browsers should be told to reload whenever an asset changes. This
+  // implies Watch. The server then handles two extra paths: '__paste/events'
+  // streams the logical names of rebuilt assets as server-sent events, and
+  // '__paste/livereload.js' is a script which listens to them, swapping out
+  // stylesheets in place and reloading the page for anything else.
+  LiveReload bool
+
+  // How often to scan for changes when watching and the OS can't report them.
+  // Defaults to one second.
+  PollInterval time.Duration
+
+  // Flag if source maps should be generated for javascript and stylesheets,
+  // mapping each line of a bundle back to the file it came from. Source maps
+  // aren't generated for compressed assets.
+  SourceMaps bool
+
+  // Content-codings (like "gzip", "br" or "zstd") to generate encoded copies
+  // of assets with when compiling. If nil, every registered encoding is used.
+  Encodings []string
+
+  // Processors, compressors and aliases to build assets with. If nil, the
+  // DefaultRegistry is used, which is what the 'Register*' functions modify.
+  Registry *Registry
+
+  // Longest time any one processor or compressor may run for when building an
+  // asset before it's cancelled, unless the registry has a timeout for its
+  // extension (see Registry.SetTimeout). Zero means no limit.
+  ProcessTimeout time.Duration
+
+  // Hash to compute subresource integrity values with, which must be one of
+  // crypto.SHA256, crypto.SHA384 or crypto.SHA512. Zero means SHA384.
+  Integrity crypto.Hash
+
+  // Hash to compute the digests in the names of assets with. Zero means MD5.
+  // Hashes other than the ones in the standard library, like crypto.BLAKE2b_256,
+  // need the package implementing them to be imported.
+  DigestHash crypto.Hash
+
+  // Number of hex characters digests are truncated to, for shorter names.
+  // Zero (or anything longer than the hash) means the whole hash is used.
+  // Anything shorter than 8 is raised to 8, since shorter digests are too
+  // easily mistaken for parts of ordinary names like 'a-1.png'.
+  DigestLength int
+
+  // Prepended to the URLs of assets generated by FuncMap, which is wherever the
+  // server is mounted, like "/assets" or the URL of a CDN
+  URLPrefix string
+
+  // Flag if tags generated by FuncMap should have integrity attributes
+  SubresourceIntegrity bool
+
+  // Value of the crossorigin attribute of script and link tags generated by
+  // FuncMap, like "anonymous". Empty means there's no such attribute.
+  CrossOrigin string
+
+  // Entry points which Compile writes out, along with everything they link to
+  // (like images referenced by stylesheets). Each is a logical name or a glob
+  // as understood by path.Match, like "application.js", "*.png" or
+  // "admin/*.css". Patterns without a slash match the base name of assets
+  // anywhere. If empty, every asset is compiled.
+  Precompile []string
 }
 
 // A processor is a method of putting an asset through a 'pipeline' of
@@ -100,10 +243,22 @@ type Processor interface {
 // Easy way of implementing a processor as just a function
 type ProcessorFunc func(infile, outfile string) error
 
-// Global registries modified by 'Register*'
-var processors = make(map[string]Processor)
-var compressors = make(map[string]Processor)
-var aliases = make(map[string][]string)
+// A processor which can be cancelled, like one running an external program.
+// When building assets, ProcessContext is called instead of Process. The
+// context is cancelled if whatever wanted the asset gives up on it, or if the
+// processor's timeout passes.
+//
+// Processors which don't implement this can't be stopped. If they time out or
+// the asset is given up on, building stops waiting for them, but they're left
+// running in the background until they finish on their own.
+type ContextProcessor interface {
+  Processor
+  ProcessContext(ctx context.Context, infile, outfile string) error
+}
+
+// Easy way of implementing a context processor as just a function
+type ContextProcessorFunc func(ctx context.Context, infile,
+                               outfile string) error
 
 // Registers a processor to run for the given extension whenever files are
 // processed. It is considered an error to register more than one processor for
@@ -121,11 +276,30 @@ var aliases = make(map[string][]string)
 //      // ... convert the sass in 'infile' to css in 'outfile'
 //    }
 func RegisterProcessor(p Processor, ext string) {
-  _, ok := processors[ext]
-  if ok {
-    panic("Processor already registered for " + ext)
+  RegisterStreamProcessor(fileProcessor{p}, ext)
+}
+
+// Same as RegisterProcessor, except for processors which work on streams
+// instead of files. Stages of processing are piped together in memory, so
+// these don't need to touch the disk at all.
+//
+// Example:
+//
+//    func init() {
+//      paste.RegisterStreamProcessor(paste.StreamProcessorFunc(upcase), ".up")
+//    }
+//
+//    func upcase(ctx context.Context, r io.Reader, w io.Writer,
+//                info paste.AssetInfo) error {
+//      bits, err := ioutil.ReadAll(r)
+//      if err != nil { return err }
+//      _, err = w.Write(bytes.ToUpper(bits))
+//      return err
+//    }
+func RegisterStreamProcessor(p StreamProcessor, ext string) {
+  if err := DefaultRegistry.RegisterStreamProcessor(p, ext); err != nil {
+    panic(err.Error())
   }
-  processors[ext] = p
 }
 
 // Registers a compressor to run for the given extension whenever files are
@@ -146,11 +320,15 @@ func RegisterProcessor(p Processor, ext string) {
 //      // ... do something like invoke the closure compiler
 //    }
 func RegisterCompressor(p Processor, ext string) {
-  _, ok := compressors[ext]
-  if ok {
-    panic("Compressor already registered for " + ext)
+  RegisterStreamCompressor(fileProcessor{p}, ext)
+}
+
+// Same as RegisterCompressor, except for compressors which work on streams
+// instead of files.
+func RegisterStreamCompressor(p StreamProcessor, ext string) {
+  if err := DefaultRegistry.RegisterStreamCompressor(p, ext); err != nil {
+    panic(err.Error())
   }
-  compressors[ext] = p
 }
 
 // Registers an alias from one extension to another. This means that any files
@@ -167,12 +345,20 @@ func RegisterCompressor(p Processor, ext string) {
 //      paste.RegisterAlias(".css", ".scss")
 //    }
 func RegisterAlias(extension, alias string) {
-  prev, ok := aliases[extension]
-  if !ok {
-    prev = make([]string, 0)
-  }
-  prev = append(prev, alias)
-  aliases[extension] = prev
+  DefaultRegistry.RegisterAlias(extension, alias)
+}
+
+// Limits how long the processor and compressor registered for the given
+// extension may run for when building an asset, see Registry.SetTimeout.
+//
+// Example:
+//
+//    func init() {
+//      paste.RegisterCompressor(optipng, ".png")
+//      paste.SetTimeout(".png", 30 * time.Second)
+//    }
+func SetTimeout(ext string, timeout time.Duration) {
+  DefaultRegistry.SetTimeout(ext, timeout)
 }
 
 // Creates a new file server for assets. This server is meant for development
@@ -185,44 +371,116 @@ func RegisterAlias(extension, alias string) {
 // The version argument is some string to prepend to all hashes such that when
 // it changes the digests of all assets will change. This is meant for an easy
 // form of 'cache busting'
+//
+// The returned server also implements io.Closer, which stops watching the
+// filesystem if the configuration asked for that.
 func FileServer(c Config) Server {
-  abs, err := filepath.Abs(c.Root)
-  if err != nil { panic(err) }
-  c.Root = abs
+  c.Paths = append([]string{}, c.Paths...)
+  if c.FS != nil {
+    c.Root = path.Clean(c.Root)
+    for i := range c.Paths {
+      c.Paths[i] = path.Clean(c.Paths[i])
+    }
+  } else {
+    abs, err := filepath.Abs(c.Root)
+    if err != nil { panic(err) }
+    c.Root = abs
+    for i := range c.Paths {
+      abs, err = filepath.Abs(c.Paths[i])
+      if err != nil { panic(err) }
+      c.Paths[i] = abs
+    }
+  }
 
-  if c.TempDir == "" {
+  if c.TempDir == "" && c.FS != nil {
+    c.TempDir = filepath.Join(os.TempDir(), "paste")
+  } else if c.TempDir == "" {
     c.TempDir = filepath.Join(c.Root, "tmp")
   } else {
-    abs, err = filepath.Abs(c.TempDir)
+    abs, err := filepath.Abs(c.TempDir)
     if err != nil { panic(err) }
     c.TempDir = abs
   }
 
-  return &fileServer{ assets: make(map[string]*assetMeta), config: c }
+  srv := &fileServer{ assets: make(map[string]*assetMeta), config: c }
+  if c.LiveReload {
+    srv.reloader = newReloader(srv)
+  }
+  if c.Watch || c.LiveReload {
+    srv.watcher = srv.watch()
+  }
+  return srv
 }
 
 func (p ProcessorFunc) Process(infile, outfile string) error {
   return p(infile, outfile)
 }
 
+func (p ContextProcessorFunc) Process(infile, outfile string) error {
+  return p(context.Background(), infile, outfile)
+}
+
+func (p ContextProcessorFunc) ProcessContext(ctx context.Context, infile,
+                                             outfile string) error {
+  return p(ctx, infile, outfile)
+}
+
 func (s *fileServer) Config() *Config {
   return &s.config
 }
 
+func (s *fileServer) Close() error {
+  if s.reloader != nil {
+    s.reloader.Close()
+  }
+  s.tmpLock.Lock()
+  if s.tmpdir != "" {
+    os.RemoveAll(s.tmpdir)
+    s.tmpdir = ""
+  }
+  s.tmpLock.Unlock()
+  if s.watcher == nil {
+    return nil
+  }
+  return s.watcher.Close()
+}
+
 func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+  if s.reloader != nil && strings.HasPrefix(r.URL.Path, livereloadPrefix) {
+    s.reloader.ServeHTTP(w, r)
+    return
+  }
   serveHTTP(s, w, r)
 }
 
-func serveHTTP(s Server, w http.ResponseWriter, r *http.Request) {
+// Implemented by assets which know what type of content they are
+type typedAsset interface {
+  contentType() string
+}
+
+func serveHTTP(s ContextServer, w http.ResponseWriter, r *http.Request) {
   dir, file := path.Split(r.URL.Path)
-  file, digest := findDigest(file)
-  asset, err := s.Asset(path.Join(dir, file))
+  asset, digest, err := findAsset(r.Context(), s, dir, file)
+
+  /* If there's no such asset, this may be the source map of an asset */
+  var srcmap string
+  if err != nil && strings.HasSuffix(file, ".map") {
+    name := strings.TrimSuffix(file, ".map")
+    asset, digest, err = findAsset(r.Context(), s, dir, name)
+    if err == nil {
+      if m, ok := unwrap(asset).(mappedAsset); ok {
+        srcmap = m.sourceMap()
+      }
+      if srcmap == "" {
+        err = errors.New("no source map for " + name)
+      }
+    }
+  }
   if err != nil || (digest != "" && digest != asset.Digest()) {
     http.NotFound(w, r)
     return
   }
 
-
   headers := w.Header()
   if digest != "" {
     endoftime := time.Now().Add(31536000 * time.Second)
@@ -231,28 +489,112 @@ func serveHTTP(s Server, w http.ResponseWriter, r *http.Request) {
   } else {
     headers.Set("Cache-Control", "must-revalidate")
   }
-  if etagMatches(w, r, asset) {
+
+  if srcmap != "" {
+    headers.Set("Content-Type", "application/json")
+    if !etagMatches(w, r, etag(asset, "map")) {
+      serveFile(w, r, asset, srcmap)
+    }
     return
   }
-  http.ServeFile(w, r, asset.Pathname())
+
+  /* The type of precompiled assets is known up front, otherwise it's guessed
+     from the name */
+  ctype := mime.TypeByExtension(path.Ext(asset.LogicalName()))
+  if t, ok := asset.(typedAsset); ok && t.contentType() != "" {
+    ctype = t.contentType()
+  }
+  if ctype != "" {
+    headers.Set("Content-Type", ctype)
+  }
+
+  /* Precompiled assets may have encoded versions sitting next to them, so
+     serve one of those instead if the client will take it. The encoded
+     version is a different entity, so it gets its own etag */
+  pathname, tag := asset.Pathname(), etag(asset, "")
+  if e, ok := asset.(encodedAsset); ok && len(e.encoded()) > 0 {
+    headers.Add("Vary", "Accept-Encoding")
+    if file := negotiateEncoding(r, e.encoded()); file != nil {
+      pathname, tag = file.path, etag(asset, file.encoding)
+      headers.Set("Content-Encoding", file.encoding)
+      if headers.Get("Content-Type") == "" {
+        headers.Set("Content-Type", "application/octet-stream")
+      }
+    }
+  }
+  if etagMatches(w, r, tag) {
+    return
+  }
+  serveFile(w, r, asset, pathname)
 }
 
-func etagMatches(w http.ResponseWriter, r *http.Request, a Asset) bool {
-  tag := r.Header.Get("If-None-Match")
-  w.Header().Set("ETag", etag(a))
-  if tag == etag(a) {
+// Serves one of the files of an asset, which may not live on the OS filesystem
+func serveFile(w http.ResponseWriter, r *http.Request, a Asset, name string) {
+  f, err := openAsset(a, name)
+  if err != nil {
+    http.NotFound(w, r)
+    return
+  }
+  defer f.Close()
+  stat, err := f.Stat()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusInternalServerError)
+    return
+  }
+  modtime := stat.ModTime()
+  if modtime.IsZero() {
+    modtime = a.ModTime()
+  }
+  content, ok := f.(io.ReadSeeker)
+  if !ok {
+    /* not all filesystems have seekable files, but http wants one */
+    bits, err := io.ReadAll(f)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusInternalServerError)
+      return
+    }
+    content = strings.NewReader(string(bits))
+  }
+  http.ServeContent(w, r, path.Base(a.LogicalName()), modtime, content)
+}
+
+func etagMatches(w http.ResponseWriter, r *http.Request, tag string) bool {
+  w.Header().Set("ETag", tag)
+  if r.Header.Get("If-None-Match") == tag {
     w.WriteHeader(http.StatusNotModified)
     return true
   }
   return false
 }
 
-func etag(a Asset) string {
-  return `"` + a.Digest() + `"`
+func etag(a Asset, encoding string) string {
+  if encoding == "" {
+    return `"` + a.Digest() + `"`
+  }
+  return `"` + a.Digest() + "-" + encoding + `"`
+}
+
+// Looks up the asset for a requested file in a directory, returning it along
+// with the digest in the file's name (if any). A name which only looks like it
+// has a digest, like 'foo-deadbeef.js', may be what an asset is really called,
+// so that's tried too if the digest doesn't match.
+func findAsset(ctx context.Context, s ContextServer, dir,
+               file string) (Asset, string, error) {
+  name, digest := findDigest(file, s.Config().digestLength())
+  asset, err := s.AssetContext(ctx, path.Join(dir, name))
+  if digest == "" || (err == nil && asset.Digest() == digest) {
+    return asset, digest, err
+  }
+  if a, e := s.AssetContext(ctx, path.Join(dir, file)); e == nil {
+    return a, "", nil
+  }
+  return asset, digest, err
 }
 
-func findDigest(file string) (string, string) {
-  matches := hashRegex.FindStringSubmatch(file)
+// Splits the digest of the given length out of a requested filename, returning
+// the name without it and the digest (or an empty digest if there's none)
+func findDigest(file string, length int) (string, string) {
+  matches := hashRegex(length).FindStringSubmatch(file)
   if len(matches) == 0 {
     return file, ""
   }
@@ -260,6 +602,11 @@ func findDigest(file string) (string, string) {
 }
 
 func (s *fileServer) Asset(logical string) (Asset, error) {
+  return s.AssetContext(context.Background(), logical)
+}
+
+func (s *fileServer) AssetContext(ctx context.Context,
+                                  logical string) (Asset, error) {
   logical = path.Clean("/" + logical)
   s.Lock()
   ret, ok := s.assets[logical]
@@ -267,27 +614,43 @@ func (s *fileServer) Asset(logical string) (Asset, error) {
     ret = &assetMeta{}
     s.assets[logical] = ret
   }
+  /* Building an asset builds its dependencies, so don't hold up the whole
+     server while waiting for another build of this asset to finish */
+  s.Unlock()
   ret.Lock()
   defer ret.Unlock()
-  s.Unlock()
   if ret.err != nil {
     return nil, ret.err
-  } else if ret.Asset == nil || ret.Stale() {
-    a, err := s.buildAsset(logical)
+  } else if ret.Asset == nil || s.stale(ret) {
+    generation := atomic.LoadUint64(&s.generation)
+    a, err := s.buildAsset(ctx, logical)
     if err == nil {
       ret.Asset = a
+      s.built(ret, generation)
     } else {
-      s.Lock()
-      delete(s.assets, logical)
-      s.Unlock()
-      ret.err = err
+      /* Giving up on a build says nothing about the asset, so the next
+         request for it tries again instead of seeing this error */
+      if ctx.Err() == nil {
+        ret.err = err
+      }
+      if ret.err != nil || ret.Asset == nil {
+        s.Lock()
+        if s.assets[logical] == ret {
+          delete(s.assets, logical)
+        }
+        s.Unlock()
+      }
       return nil, err
     }
   }
   return ret, nil
 }
 
-func (s *fileServer) buildAsset(logical string) (Asset, error) {
+func (s *fileServer) buildAsset(ctx context.Context,
+                                logical string) (Asset, error) {
+  if err := ctx.Err(); err != nil {
+    return nil, err
+  }
   pathname, err := s.resolve(logical)
   if err != nil {
     return nil, err
@@ -295,31 +658,45 @@ func (s *fileServer) buildAsset(logical string) (Asset, error) {
 
   /* If we have a processor, or possibly a compressor, or this is js/css which
      could possibly have requires at the top, then we need a processed asset */
-  _, ok1 := processors[path.Ext(pathname)]
-  _, ok2 := compressors[path.Ext(logical)]
-  if ok1 || (ok2 && s.config.Compressed) ||
+  chain, _ := s.registry().processorChain(filepath.Base(pathname))
+  _, ok := s.registry().compressor(path.Ext(logical))
+  if len(chain) > 0 || (ok && s.config.Compressed) ||
       path.Ext(logical) == ".js" || path.Ext(logical) == ".css" {
-    return newProcessed(s, logical, pathname)
+    return newProcessed(ctx, s, logical, pathname)
   }
   return newStatic(s, logical, pathname)
 }
 
 func (s *fileServer) resolve(logical string) (string, error) {
-  try := filepath.Join(s.config.Root, logical)
-  _, err := os.Stat(try)
-  if err == nil {
-    return try, nil
-  }
-  ext := filepath.Ext(logical)
-  candidates, ok := aliases[ext]
-  if ok {
-    for _, cand := range candidates {
-      try = filepath.Join(s.config.Root, logical[:len(logical) - len(ext)] + cand)
-      _, err = os.Stat(try)
+  var err error
+  ext := path.Ext(logical)
+  rels := []string{logical}
+  for _, cand := range s.registry().aliasesOf(ext) {
+    rels = append(rels, logical[:len(logical) - len(ext)] + cand)
+  }
+  for _, root := range s.roots() {
+    for _, rel := range rels {
+      try := s.sourceName(root, rel)
+      if s.ignored(root, rel) {
+        err = &fs.PathError{ Op: "stat", Path: try, Err: fs.ErrNotExist }
+        continue
+      }
+      _, err = s.stat(try)
       if err == nil {
         return try, nil
       }
     }
+
+    /* Stacked extensions like 'foo.js.tmpl' can't be guessed, so look for
+       anything in the directory which would turn into this asset */
+    dir, base := path.Split(logical)
+    entries, _ := s.readRootDir(root, dir)
+    for _, entry := range entries {
+      name := entry.Name()
+      if !entry.IsDir() && s.registry().logicalName(name) == base {
+        return s.sourceName(root, path.Join(dir, name)), nil
+      }
+    }
   }
   return "", err
 }
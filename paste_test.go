@@ -7,6 +7,7 @@ import "os"
 import "path/filepath"
 import "strings"
 import "testing"
+import "testing/fstest"
 import "time"
 
 func check(t *testing.T, e error) {
@@ -22,21 +23,27 @@ func testEq(t *testing.T, a, b string) {
 }
 
 func TestFindDigest(t *testing.T) {
-  a, b := findDigest("foo.js")
+  a, b := findDigest("foo.js", 32)
   testEq(t, a, "foo.js")
   testEq(t, b, "")
-  a, b = findDigest("foo")
+  a, b = findDigest("foo", 32)
   testEq(t, a, "foo")
   testEq(t, b, "")
-  a, b = findDigest("foo-bar.js")
+  a, b = findDigest("foo-bar.js", 32)
   testEq(t, a, "foo-bar.js")
   testEq(t, b, "")
-  a, b = findDigest("foo-ba455f38e701f688ace552f2d2cb69d3.js")
+  a, b = findDigest("foo-ba455f38e701f688ace552f2d2cb69d3.js", 32)
   testEq(t, a, "foo.js")
   testEq(t, b, "ba455f38e701f688ace552f2d2cb69d3")
-  a, b = findDigest("foo-ba455f38e701f688ace552f2d2cb69dz.js")
+  a, b = findDigest("foo-ba455f38e701f688ace552f2d2cb69dz.js", 32)
   testEq(t, a, "foo-ba455f38e701f688ace552f2d2cb69dz.js")
   testEq(t, b, "")
+  a, b = findDigest("foo-ba455f38.js", 8)
+  testEq(t, a, "foo.js")
+  testEq(t, b, "ba455f38")
+  a, b = findDigest("foo-ba455f38e701f688ace552f2d2cb69d3.js", 8)
+  testEq(t, a, "foo-ba455f38e701f688ace552f2d2cb69d3.js")
+  testEq(t, b, "")
 }
 
 func stubServer(t *testing.T) (*fileServer, string) {
@@ -183,3 +190,170 @@ func TestAssetPaths(t *testing.T) {
   }
   testEq(t, ret, "/foo.js")
 }
+
+func TestFS(t *testing.T) {
+  tmpdir, err := ioutil.TempDir(os.TempDir(), "paste")
+  check(t, err)
+  defer os.RemoveAll(tmpdir)
+  file := func(contents string) *fstest.MapFile {
+    return &fstest.MapFile{Data: []byte(contents), ModTime: time.Now()}
+  }
+  fsys := fstest.MapFS{
+    "assets/foo.js": file("//= require bar\nfoo"),
+    "assets/bar.js": file("bar"),
+    "assets/foo.png": file("png"),
+    "foo.txt": file("outside"),
+  }
+  srv := httptest.NewServer(FileServer(Config{FS: fsys, Root: "assets",
+                                               TempDir: tmpdir}))
+  defer srv.Close()
+
+  resp, err := http.Get(srv.URL + "/foo.js")
+  check(t, err)
+  tag := ValidateHeaders(t, resp, "bar\n//= require bar\nfoo", "")
+  resp, err = http.Get(srv.URL + "/foo-" + tag + ".js")
+  check(t, err)
+  ValidateHeaders(t, resp, "bar\n//= require bar\nfoo", tag)
+  resp, err = http.Get(srv.URL + "/foo.png")
+  check(t, err)
+  ValidateHeaders(t, resp, "png", "")
+  resp, err = http.Get(srv.URL + "/foo.txt")
+  check(t, err)
+  if resp.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 return, got %d", resp.StatusCode)
+  }
+}
+
+func TestGetSourceMap(t *testing.T) {
+  fs, wd := stubServer(t)
+  fs.Config().SourceMaps = true
+  srv := httptest.NewServer(fs)
+  defer srv.Close()
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "foo.js", "asdf")
+  stubFile(t, wd, "foo.png", "foo")
+  a, err := fs.Asset("foo.js")
+  check(t, err)
+
+  for _, url := range []string{"/foo.js.map",
+                               "/foo-" + a.Digest() + ".js.map"} {
+    resp, err := http.Get(srv.URL + url)
+    check(t, err)
+    if resp.StatusCode != http.StatusOK {
+      t.Fatalf("expected 200 return, got %d", resp.StatusCode)
+    }
+    testEq(t, resp.Header.Get("Content-Type"), "application/json")
+  }
+  for _, url := range []string{"/foo.png.map", "/bar.js.map"} {
+    resp, err := http.Get(srv.URL + url)
+    check(t, err)
+    if resp.StatusCode != http.StatusNotFound {
+      t.Errorf("expected 404 return, got %d", resp.StatusCode)
+    }
+  }
+}
+
+func stubPathsServer(t *testing.T) (Server, string) {
+  tmpdir, err := ioutil.TempDir(os.TempDir(), "paste")
+  check(t, err)
+  stubFile(t, tmpdir, "app/foo.js", "app-foo")
+  stubFile(t, tmpdir, "vendor/foo.js", "vendor-foo")
+  stubFile(t, tmpdir, "vendor/jquery.js", "jq")
+  stubFile(t, tmpdir, "shared/lib/a.js", "a")
+  stubFile(t, tmpdir, "app/lib/b.js", "b")
+  stubFile(t, tmpdir, "app/app.js", "//= require jquery\n//= require_tree lib")
+  srv := FileServer(Config{
+    Root: filepath.Join(tmpdir, "app"),
+    Paths: []string{filepath.Join(tmpdir, "vendor"),
+                    filepath.Join(tmpdir, "shared")},
+  })
+  return srv, tmpdir
+}
+
+func TestPaths(t *testing.T) {
+  fs, wd := stubPathsServer(t)
+  defer os.RemoveAll(wd)
+  srv := httptest.NewServer(fs)
+  defer srv.Close()
+
+  resp, err := http.Get(srv.URL + "/foo.js")
+  check(t, err)
+  ValidateHeaders(t, resp, "app-foo", "")
+  resp, err = http.Get(srv.URL + "/lib/a.js")
+  check(t, err)
+  ValidateHeaders(t, resp, "a", "")
+  resp, err = http.Get(srv.URL + "/app.js")
+  check(t, err)
+  ValidateHeaders(t, resp, "jq\na\nb\n//= require jquery\n//= require_tree lib",
+                  "")
+}
+
+func TestIgnore(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  srv.config.Ignore = []string{"vendor", "lib/*.orig.js"}
+  stubFile(t, wd, "foo.js", "foo")
+  stubFile(t, wd, "lib/a.js", "a")
+  stubFile(t, wd, "lib/a.orig.js", "orig")
+  stubFile(t, wd, "lib/.hidden.js", "hidden")
+  stubFile(t, wd, "lib/a.js.swp", "swap")
+  stubFile(t, wd, "lib/a.js~", "backup")
+  stubFile(t, wd, ".git/x.js", "git")
+  stubFile(t, wd, "vendor/v.js", "vendor")
+  stubFile(t, wd, "tmp/t.js", "temp")
+  stubFile(t, wd, "app.js", "//= require_tree .")
+
+  for _, logical := range []string{"lib/a.orig.js", "lib/.hidden.js",
+                                   "lib/a.js.swp", "lib/a.js~", ".git/x.js",
+                                   "vendor/v.js", "tmp/t.js"} {
+    if _, err := srv.Asset(logical); err == nil {
+      t.Errorf("%s should be ignored", logical)
+    }
+  }
+  app, err := srv.Asset("app.js")
+  check(t, err)
+  bits, err := ioutil.ReadFile(app.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "foo\na\n//= require_tree .")
+
+  found := make([]string, 0)
+  check(t, srv.walk(func(root, name string) error {
+    rel, _ := srv.relativeTo(root, name)
+    found = append(found, rel)
+    return nil
+  }))
+  testEq(t, strings.Join(found, " "), "app.js foo.js lib/a.js")
+}
+
+func TestGetDigestLookalike(t *testing.T) {
+  fs, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  fs.config.DigestLength = 8
+  srv := httptest.NewServer(fs)
+  defer srv.Close()
+  stubFile(t, wd, "a-deadbeef.png", "a")
+
+  /* the name looks digested, but it's just what the file is called */
+  resp, err := http.Get(srv.URL + "/a-deadbeef.png")
+  check(t, err)
+  tag := ValidateHeaders(t, resp, "a", "")
+  resp, err = http.Get(srv.URL + "/a-deadbeef-" + tag + ".png")
+  check(t, err)
+  ValidateHeaders(t, resp, "a", tag)
+  resp, err = http.Get(srv.URL + "/a-0badf00d.png")
+  check(t, err)
+  if resp.StatusCode != http.StatusNotFound {
+    t.Errorf("expected 404 return, got %d", resp.StatusCode)
+  }
+}
+
+func TestDigestLengthMinimum(t *testing.T) {
+  for length, expected := range map[int]int{0: 32, 1: 8, 7: 8, 8: 8, 12: 12,
+                                            100: 32} {
+    c := Config{DigestLength: length}
+    if c.digestLength() != expected {
+      t.Errorf("length %d should be %d, got %d", length, expected,
+               c.digestLength())
+    }
+  }
+}
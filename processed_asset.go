@@ -1,6 +1,8 @@
 package paste
 
 import "bufio"
+import "context"
+import "errors"
 import "io"
 import "io/ioutil"
 import "os"
@@ -14,134 +16,583 @@ type processedAsset struct {
   static *staticAsset
   dependencies []Asset
 
+  /* Every asset which goes into the bundle for this asset, in order, with
+     each asset only appearing once. This asset itself is included as well */
+  flattened []Asset
+
+  /* The contents of just this asset, after being processed. If the source
+     didn't need processing, 'bodysrc' is where the body can be opened from,
+     and 'bodyname' is what the body is called in source maps */
+  body     string
+  bodysrc  Asset
+  bodyname string
+
+  /* Assets referenced by url() in stylesheets, by logical name. They're
+     dependencies as well, since their digests end up in the bundle */
+  links  []Asset
+  linked map[string]Asset
+
+  /* Directories included through require_tree and require_directory, along
+     with the assets that were found in them, to notice additions/removals */
+  directories map[string][]string
+
   digest   string
   mtime    time.Time
   pathname string
+
+  /* If source maps are generated, the served file has a comment pointing at
+     the map appended to it, and 'bundle' is the contents without it */
+  bundle   string
+  srcmap   *sourceMap
+  mappath  string
 }
 
-var jsRequires = regexp.MustCompile(`^//=\s*require\s+(\S+)`)
+// Implemented by assets which may have a source map. An empty pathname means
+// that there is no source map.
+type mappedAsset interface {
+  sourceMap() string
+}
+
+// Matches the text of a comment in the header of a file which is a directive,
+// such as '= require foo'
+var directiveRegex = regexp.MustCompile(`^=\s*(\w+)(?:\s+(\S+))?`)
 
 func (s *processedAsset) Digest() string      { return s.digest }
 func (s *processedAsset) Pathname() string    { return s.pathname }
 func (s *processedAsset) ModTime() time.Time  { return s.mtime }
 func (s *processedAsset) LogicalName() string { return s.static.logical }
+func (s *processedAsset) sourceMap() string   { return s.mappath }
 
 func (s *processedAsset) Stale() bool {
   if s.static.Stale() { return true }
+  for dir, found := range s.directories {
+    recursive := strings.HasSuffix(dir, "/...")
+    now, err := s.listDirectory(strings.TrimSuffix(dir, "/..."), recursive)
+    if err != nil || strings.Join(now, "\n") != strings.Join(found, "\n") {
+      return true
+    }
+  }
   for _, d := range s.dependencies {
     if d.Stale() {
       return true
     }
   }
+  for _, l := range s.links {
+    if l.Stale() {
+      return true
+    }
+  }
   return false
 }
 
-func newProcessed(s *fileServer, logical, path string) (Asset, error) {
+func newProcessed(ctx context.Context, s *fileServer, logical,
+                  path string) (Asset, error) {
   static, err := newStatic(s, logical, path)
   if err != nil {
     return nil, err
   }
 
-  asset := &processedAsset{static: static, dependencies: make([]Asset, 0)}
+  asset := &processedAsset{static: static, dependencies: make([]Asset, 0),
+                           directories: make(map[string][]string)}
 
-  /* Process and compress the asset */
-  processor, ok := processors[filepath.Ext(asset.static.pathname)]
-  src := asset.static.pathname
-  if ok {
-    dst, err := ioutil.TempFile("", "paste")
-    if err == nil {
-      dst.Close()
-      err = processor.Process(src, dst.Name())
-      src = dst.Name()
-      defer os.Remove(src)
+  /* Process the asset, keeping the result around for everything requiring
+     this asset to use as well */
+  steps, _ := s.registry().processorChain(filepath.Base(asset.static.pathname))
+  asset.body = asset.static.pathname
+  asset.bodysrc = asset.static
+  asset.bodyname = "/" + s.relativeName(asset.static.pathname)
+  ext := filepath.Ext(logical)
+  if len(steps) > 0 {
+    /* Each stage is told what's left of the source's name so processors can
+       tell what they're given */
+    name := filepath.Base(asset.static.pathname)
+    stages := make([]stage, len(steps))
+    for i, processor := range steps {
+      info := AssetInfo{LogicalName: logical, Pathname: asset.static.pathname,
+                        Name: name}
+      timeout := s.registry().timeout(filepath.Ext(name),
+                                      s.config.ProcessTimeout)
+      name = name[:len(name) - len(filepath.Ext(name))]
+      info.Ext = filepath.Ext(name)
+      if i == len(steps) - 1 || info.Ext == "" {
+        info.Ext = ext
+      }
+      stages[i] = stage{processor, info, timeout}
     }
+
+    /* The body is named after the asset so rebuilding it replaces the old
+       one, and it's written elsewhere first so it's never seen half done */
+    in, err := s.open(asset.static.pathname)
+    if err != nil { return nil, err }
+    defer in.Close()
+    tmp, err := s.tempDir()
+    if err != nil { return nil, err }
+    body := filepath.Join(tmp, "body", filepath.FromSlash(logical))
+    os.MkdirAll(filepath.Dir(body), 0755)
+    out, err := ioutil.TempFile(filepath.Dir(body), "paste")
     if err != nil { return nil, err }
+    err = pipeline(ctx, stages, in, out)
+    out.Close()
+    if err == nil {
+      err = os.Rename(out.Name(), body)
+    }
+    if err != nil {
+      os.Remove(out.Name())
+      return nil, err
+    }
+    /* processed output no longer resembles the source, so it's what gets
+       mapped to in source maps, under the logical name */
+    asset.body, asset.bodysrc = body, nil
+    asset.bodyname = "/" + strings.TrimPrefix(logical, "/")
   }
 
-  paths, err := asset.requiredPaths(jsRequires)
+  paths, self, err := asset.requiredPaths()
   if err != nil {
     return nil, err
   }
 
-  /* collect the digests and mtimes into the processed version */
-  digest := asset.static.digest
+  /* Building a dependency which requires this asset would deadlock on this
+     asset, so make sure that isn't going to happen first */
+  chain := []string{"/" + strings.TrimPrefix(logical, "/")}
+  if err = s.findCycle(chain, paths, make(map[string]bool)); err != nil {
+    return nil, err
+  }
+
+  /* Flatten out everything required, directly or not, so each asset is only
+     included once and always after what it requires */
+  seen := make(map[string]bool)
+  include := func(a Asset) {
+    a = unwrap(a)
+    if !seen[a.LogicalName()] {
+      seen[a.LogicalName()] = true
+      asset.flattened = append(asset.flattened, a)
+    }
+  }
   asset.mtime = asset.static.mtime
-  for _, dep := range paths {
-    d, err := s.Asset(dep)
+  for i, dep := range paths {
+    if i == self {
+      include(asset)
+    }
+    d, err := s.AssetContext(ctx, dep)
     if err != nil {
       return nil, err
     }
     asset.dependencies = append(asset.dependencies, d)
-
-    digest += d.Digest()
+    if p, ok := unwrap(d).(*processedAsset); ok {
+      for _, a := range p.flattened {
+        include(a)
+      }
+    } else {
+      include(d)
+    }
     if d.ModTime().After(asset.mtime) {
       asset.mtime = d.ModTime()
     }
   }
-  asset.digest = hexdigestString(s, digest)
+  if self == len(paths) {
+    include(asset)
+  }
 
-  /* Concatenate all assets into a temp file */
-  compiled := filepath.Join(s.config.TempDir, asset.digest)
-  compiled += filepath.Ext(logical)
+  /* References in stylesheets are rewritten to the digested names of what
+     they refer to */
+  if ext == ".css" {
+    if err = asset.findLinks(ctx); err != nil {
+      return nil, err
+    }
+  }
+
+  /* The bundle's digest is derived from what's in it */
+  digest := ""
+  for _, a := range asset.flattened {
+    if p, ok := a.(*processedAsset); ok {
+      digest += p.static.digest
+    } else {
+      digest += a.Digest()
+    }
+  }
+  for _, l := range asset.links {
+    digest += l.Digest()
+  }
+  asset.digest, err = hexdigestString(s, digest)
+  if err != nil {
+    return nil, err
+  }
+
+  /* Concatenate all assets into a temp file, keeping track of where all the
+     lines came from if a source map is wanted */
+  if s.config.SourceMaps && (ext == ".js" || ext == ".css") {
+    asset.srcmap = &sourceMap{}
+  }
+  tmp, err := s.tempDir()
+  if err != nil {
+    return nil, err
+  }
+  compiled := filepath.Join(tmp, asset.digest) + ext
   os.MkdirAll(filepath.Dir(compiled), 0755)
   file, err := os.Create(compiled)
   if err != nil {
     return nil, err
   }
   asset.pathname = file.Name()
-  for _, dep := range asset.dependencies {
-    copyFile(file, dep.Pathname())
-    file.Write([]byte{'\n'})
+  asset.bundle = file.Name()
+  for i, a := range asset.flattened {
+    if i > 0 {
+      file.Write([]byte{'\n'})
+      if asset.srcmap != nil {
+        asset.srcmap.addUnmapped("\n")
+      }
+    }
+    asset.concat(file, a)
   }
-  copyFile(file, src)
   file.Close()
 
-  compressor, ok := compressors[filepath.Ext(asset.static.logical)]
+  compressor, ok := s.registry().compressor(filepath.Ext(logical))
   if ok && s.config.Compressed {
-    dst, err := ioutil.TempFile("", "paste")
-    if err == nil {
-      dst.Close()
-      err = compressor.Process(compiled, dst.Name())
-      if err == nil {
-        os.Rename(dst.Name(), compiled)
-      }
+    /* there's no telling where compressors move lines, so no source map */
+    asset.srcmap = nil
+    info := AssetInfo{LogicalName: logical, Pathname: asset.static.pathname,
+                      Name: filepath.Base(compiled), Ext: ext}
+    timeout := s.registry().timeout(ext, s.config.ProcessTimeout)
+    err = compress(ctx, stage{compressor, info, timeout}, compiled)
+    if err != nil {
+      return nil, err
+    }
+  }
+
+  if asset.srcmap != nil {
+    if err = asset.writeSourceMap(); err != nil {
+      return nil, err
     }
-    if err != nil { return nil, err }
   }
 
   return asset, nil
 }
 
-func (s *processedAsset) requiredPaths(rx *regexp.Regexp) ([]string, error) {
-  f, err := os.Open(s.static.pathname)
+// Runs a compressor over a file, replacing it with the compressed version
+func compress(ctx context.Context, compressor stage, name string) error {
+  in, err := os.Open(name)
+  if err != nil { return err }
+  defer in.Close()
+  dst, err := ioutil.TempFile(filepath.Dir(name), "paste")
+  if err != nil { return err }
+  err = pipeline(ctx, []stage{compressor}, in, dst)
+  dst.Close()
+  if err == nil {
+    err = os.Rename(dst.Name(), name)
+  }
   if err != nil {
-    return nil, err
+    os.Remove(dst.Name())
+  }
+  return err
+}
+
+// Returns the logical names of everything which goes into an asset other than
+// the asset itself, which is everything bundled into it and everything it
+// links to
+func assetDependencies(a Asset) []string {
+  p, ok := unwrap(a).(*processedAsset)
+  if !ok {
+    return nil
+  }
+  deps := make([]string, 0)
+  for _, f := range p.flattened {
+    if f != p {
+      deps = append(deps, path.Join("/", f.LogicalName()))
+    }
+  }
+  for _, l := range p.links {
+    deps = append(deps, path.Join("/", l.LogicalName()))
+  }
+  return deps
+}
+
+// Parses the directives at the top of the source of this asset, returning the
+// logical paths of all required assets in order. The returned index is where
+// the contents of this asset itself should go among the required assets.
+func (s *processedAsset) requiredPaths() ([]string, int, error) {
+  f, err := s.static.srv.open(s.static.pathname)
+  if err != nil {
+    return nil, 0, err
   }
   defer f.Close()
-  buf := bufio.NewReader(f)
+  /* '#' starts an id selector in stylesheets, not a comment */
+  hash := path.Ext(s.static.logical) != ".css"
+  directives, err := headerDirectives(f, hash)
+  if err != nil {
+    return nil, 0, err
+  }
+
   paths := make([]string, 0)
+  self := -1
+  seen := make(map[string]bool)
+  add := func(p string) {
+    if !seen[p] && p != s.static.logical {
+      seen[p] = true
+      paths = append(paths, p)
+    }
+  }
+  for _, matches := range directives {
+    directive, arg := matches[1], matches[2]
+    switch directive {
+    case "require", "require_tree", "require_directory":
+      if arg == "" {
+        return nil, 0, errors.New(directive + " needs an argument in " +
+                                  s.static.logical)
+      }
+    }
+    switch directive {
+    case "require":
+      if path.Ext(arg) == "" {
+        arg += path.Ext(s.static.logical)
+      }
+      add(s.directivePath(arg))
+
+    case "require_self":
+      if self != -1 {
+        return nil, 0, errors.New("require_self used twice in " +
+                                  s.static.logical)
+      }
+      self = len(paths)
+
+    case "require_tree", "require_directory":
+      recursive := directive == "require_tree"
+      dir := s.directivePath(arg)
+      found, err := s.listDirectory(dir, recursive)
+      if err != nil {
+        return nil, 0, err
+      }
+      if recursive {
+        dir += "/..."
+      }
+      s.directories[dir] = found
+      for _, p := range found {
+        add(p)
+      }
+
+    /* Anything else may be meant for some other tool, like the 'stub' and
+       'link' directives of sprockets, so it's left alone */
+    }
+  }
+  if self == -1 {
+    self = len(paths)
+  }
+  return paths, self, nil
+}
+
+// Reads the header of a file, the comments at the very top, and returns all
+// directives found in it as the directive name followed by its argument (which
+// may be empty). The header can be made of '//' line comments, '/* */' block
+// comments and, if 'hash' is set, '#' line comments:
+//
+//    //= require foo
+//
+//    /*
+//     *= require foo
+//     */
+//
+//    #= require foo
+func headerDirectives(r io.Reader, hash bool) ([][]string, error) {
+  buf := bufio.NewReader(r)
+  directives := make([][]string, 0)
+  block := false
   for {
     line, err := buf.ReadString('\n')
-    if err == io.EOF {
-      break
-    } else if err != nil {
+    if err != nil && err != io.EOF {
       return nil, err
+    } else if err == io.EOF && line == "" {
+      break
     }
-    if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "//") { break }
-    matches := rx.FindStringSubmatch(line)
-    if len(matches) > 1 {
-      match := matches[1]
-      if path.Ext(match) == "" {
-        match += path.Ext(s.static.logical)
+
+    /* Figure out the text of the comment on this line, if any */
+    text := strings.TrimSpace(line)
+    done := false
+    if block {
+      if end := strings.Index(text, "*/"); end != -1 {
+        block = false
+        done = strings.TrimSpace(text[end + 2:]) != ""
+        text = text[:end]
       }
-      paths = append(paths, match)
+      text = strings.TrimLeft(text, "*")
+    } else if text == "" {
+      continue
+    } else if strings.HasPrefix(text, "//") {
+      text = text[2:]
+    } else if hash && strings.HasPrefix(text, "#") {
+      text = text[1:]
+    } else if strings.HasPrefix(text, "/*") {
+      text = text[2:]
+      block = true
+      if end := strings.Index(text, "*/"); end != -1 {
+        block = false
+        done = strings.TrimSpace(text[end + 2:]) != ""
+        text = text[:end]
+      }
+    } else {
+      break
+    }
+
+    matches := directiveRegex.FindStringSubmatch(strings.TrimSpace(text))
+    if len(matches) > 0 {
+      directives = append(directives, matches)
+    }
+    if done || err == io.EOF {
+      break
+    }
+  }
+  return directives, nil
+}
+
+// Returned when assets require each other in a cycle, which means that none of
+// them can be built.
+type CycleError struct {
+  // The logical paths of the assets in the cycle, in the order they require
+  // each other. The first and last elements are the same asset.
+  Chain []string
+}
+
+func (e *CycleError) Error() string {
+  return "circular require: " + strings.Join(e.Chain, " -> ")
+}
+
+// Walks the graph of requires starting at 'deps', which are required by the
+// last asset in 'chain', looking for any asset which is already in the chain.
+// Assets in 'done' are known to not lead to a cycle. This only looks at the
+// directives in the sources of assets, so no assets are built along the way.
+func (s *fileServer) findCycle(chain, deps []string, done map[string]bool) error {
+  for _, dep := range deps {
+    dep = path.Clean("/" + dep)
+    for i, prev := range chain {
+      if prev == dep {
+        cycle := append([]string{}, chain[i:]...)
+        return &CycleError{ Chain: append(cycle, dep) }
+      }
+    }
+    if done[dep] {
+      continue
+    }
+    /* Missing assets are reported when actually building them */
+    pathname, err := s.resolve(dep)
+    if err != nil {
+      continue
+    }
+    static := &staticAsset{ logical: dep, pathname: pathname, srv: s }
+    asset := &processedAsset{ static: static,
+                              directories: make(map[string][]string) }
+    paths, _, err := asset.requiredPaths()
+    if err != nil {
+      continue
+    }
+    if err = s.findCycle(append(chain, dep), paths, done); err != nil {
+      return err
+    }
+    done[dep] = true
+  }
+  return nil
+}
+
+// Arguments to directives are relative to the root of all assets, unless they
+// are '.' or '..' or start with './' or '../', in which case they're relative
+// to the directory of this asset
+func (s *processedAsset) directivePath(arg string) string {
+  if arg == "." || arg == ".." || strings.HasPrefix(arg, "./") ||
+      strings.HasPrefix(arg, "../") {
+    return path.Join(path.Dir(s.static.logical), arg)
+  }
+  return path.Join("/", arg)
+}
+
+// Lists the logical paths of all assets in the given logical directory which
+// have the same type as this asset, sorted by name. If recursive, assets in
+// subdirectories are included as well, in the place of the subdirectory.
+func (s *processedAsset) listDirectory(dir string, recursive bool) ([]string,
+                                                                   error) {
+  srv := s.static.srv
+  entries, err := srv.readDir(dir)
+  if err != nil {
+    return nil, err
+  }
+  ext := path.Ext(s.static.logical)
+  paths := make([]string, 0)
+  for _, entry := range entries {
+    logical := path.Join(dir, entry.Name())
+    if entry.IsDir() {
+      if recursive {
+        more, err := s.listDirectory(logical, true)
+        if err != nil {
+          return nil, err
+        }
+        paths = append(paths, more...)
+      }
+      continue
+    }
+    logical = srv.registry().logicalName(logical)
+    if path.Ext(logical) == ext && logical != s.static.logical {
+      paths = append(paths, logical)
     }
   }
   return paths, nil
 }
 
-func copyFile(w io.Writer, path string) {
-  f, err := os.Open(path)
+// Returns the body of an asset which is part of this bundle
+func (s *processedAsset) segment(a Asset) string {
+  src, path := a, a.Pathname()
+  if p, ok := a.(*processedAsset); ok {
+    src, path = p.bodysrc, p.body
+  }
+  var buf strings.Builder
+  copyFile(&buf, src, path)
+  return buf.String()
+}
+
+// Appends the body of an asset to the bundle being generated for this asset
+func (s *processedAsset) concat(w io.Writer, a Asset) {
+  src, path, name := a, a.Pathname(), a.LogicalName()
+  if p, ok := a.(*processedAsset); ok {
+    src, path, name = p.bodysrc, p.body, p.bodyname
+  }
+  if s.srcmap == nil && s.linked == nil {
+    copyFile(w, src, path)
+    return
+  }
+  body := s.segment(a)
+  generated := body
+  if s.linked != nil {
+    generated = s.rewriteURLs(a, body)
+  }
+  io.WriteString(w, generated)
+  if s.srcmap != nil {
+    s.srcmap.addSource(name, body, generated)
+  }
+}
+
+// Writes out the source map of this asset next to the bundle, along with a
+// copy of the bundle which points at the map
+func (s *processedAsset) writeSourceMap() error {
+  logical := s.static.logical
+  ext := path.Ext(logical)
+  file := path.Base(logical[:len(logical) - len(ext)]) + "-" + s.digest + ext
+  bits, err := s.srcmap.encode(file)
+  if err != nil { return err }
+  s.mappath = s.bundle + ".map"
+  if err = ioutil.WriteFile(s.mappath, bits, 0644); err != nil {
+    return err
+  }
+
+  comment := "\n//# sourceMappingURL=" + file + ".map\n"
+  if ext == ".css" {
+    comment = "\n/*# sourceMappingURL=" + file + ".map */\n"
+  }
+  s.pathname = s.bundle[:len(s.bundle) - len(ext)] + "-mapped" + ext
+  out, err := os.Create(s.pathname)
+  if err != nil { return err }
+  defer out.Close()
+  copyFile(out, nil, s.bundle)
+  _, err = out.Write([]byte(comment))
+  return err
+}
+
+func copyFile(w io.Writer, a Asset, path string) {
+  f, err := openAsset(a, path)
   if err != nil { panic(err) }
   io.Copy(w, f)
   f.Close()
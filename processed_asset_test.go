@@ -1,10 +1,42 @@
 package paste
 
+import "context"
+import "io"
 import "testing"
 import "os"
 import "io/ioutil"
 import "time"
 import "path/filepath"
+import "strings"
+import "testing/fstest"
+
+var background = context.Background()
+
+func init() {
+  RegisterProcessor(ProcessorFunc(fillTemplate), ".tmpl")
+  RegisterStreamProcessor(StreamProcessorFunc(upcase), ".up")
+  RegisterAlias(".css", ".up")
+}
+
+func rewrite(infile, outfile string, f func(string) string) error {
+  bits, err := ioutil.ReadFile(infile)
+  if err != nil { return err }
+  return ioutil.WriteFile(outfile, []byte(f(string(bits))), 0644)
+}
+
+func fillTemplate(infile, outfile string) error {
+  return rewrite(infile, outfile, func(s string) string {
+    return strings.Replace(s, "{{name}}", "paste", -1)
+  })
+}
+
+func upcase(ctx context.Context, r io.Reader, w io.Writer,
+            info AssetInfo) error {
+  bits, err := ioutil.ReadAll(r)
+  if err != nil { return err }
+  _, err = w.Write([]byte(strings.ToUpper(string(bits))))
+  return err
+}
 
 func TestProcessedSingleFile(t *testing.T) {
   srv, wd := stubServer(t)
@@ -12,7 +44,7 @@ func TestProcessedSingleFile(t *testing.T) {
   stubFile(t, wd, "foo.js", "bar")
   file := filepath.Join(wd, "foo.js")
 
-  asset, err := newProcessed(srv, "foo.js", file)
+  asset, err := newProcessed(background, srv, "foo.js", file)
   if err != nil {
     t.Fatalf("ran into error: %s", err.Error())
   }
@@ -46,7 +78,7 @@ func TestProcessedConcatenates(t *testing.T) {
   stubFile(t, wd, "baz.js", "baz")
   file := filepath.Join(wd, "foo.js")
 
-  asset, err := newProcessed(srv, "foo.js", file)
+  asset, err := newProcessed(background, srv, "foo.js", file)
   if err != nil {
     t.Fatalf("ran into error: %s", err.Error())
   }
@@ -70,3 +102,363 @@ func TestProcessedConcatenates(t *testing.T) {
     t.Errorf("should be stale now with new contents")
   }
 }
+
+func TestProcessedRequireTree(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  src := "//= require_tree ./lib\n//= require_self\n" +
+         "//= require_directory ./vendor\napp"
+  stubFile(t, wd, "js/app.js", src)
+  stubFile(t, wd, "js/lib/b.js", "b")
+  stubFile(t, wd, "js/lib/a.js", "a")
+  stubFile(t, wd, "js/lib/sub/c.js", "c")
+  stubFile(t, wd, "js/lib/x.css", "x")
+  stubFile(t, wd, "js/vendor/v.js", "v")
+  stubFile(t, wd, "js/vendor/sub/w.js", "w")
+
+  asset, err := newProcessed(background, srv, "/js/app.js",
+                             filepath.Join(wd, "js/app.js"))
+  if err != nil {
+    t.Fatalf("ran into error: %s", err.Error())
+  }
+  bits, err := ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "a\nb\nc\n" + src + "\nv")
+  if asset.Stale() {
+    t.Errorf("shouldn't be stale")
+  }
+
+  stubFile(t, wd, "js/lib/sub/d.js", "d")
+  if !asset.Stale() {
+    t.Errorf("should be stale with a new file in the tree")
+  }
+}
+
+func TestProcessedUnknownDirective(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  src := "//= include bar\n//= stub\n//= require bar\nfoo"
+  stubFile(t, wd, "foo.js", src)
+  stubFile(t, wd, "bar.js", "bar")
+
+  asset, err := newProcessed(background, srv, "/foo.js",
+                             filepath.Join(wd, "foo.js"))
+  check(t, err)
+  bits, err := ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "bar\n" + src)
+
+  stubFile(t, wd, "baz.js", "//= require\nbaz")
+  _, err = newProcessed(background, srv, "/baz.js",
+                        filepath.Join(wd, "baz.js"))
+  if err == nil {
+    t.Errorf("expected an error for a require without a path")
+  }
+}
+
+func TestDirectivePath(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  asset := &processedAsset{ static: &staticAsset{ logical: "/js/app.js",
+                                                  srv: srv } }
+  for arg, expected := range map[string]string{
+    "foo": "/foo",
+    ".hidden": "/.hidden",
+    "..foo": "/..foo",
+    ".": "/js",
+    "./foo": "/js/foo",
+    "..": "/",
+    "../foo": "/foo",
+    "lib/foo": "/lib/foo",
+  } {
+    testEq(t, asset.directivePath(arg), expected)
+  }
+}
+
+func TestProcessedBlockComments(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  src := "/*= require reset */\n/*\n *= require_self\n *= require a\n */\n" +
+         "/*= require b */ #c {}\n/*= require d */"
+  stubFile(t, wd, "foo.css", src)
+  stubFile(t, wd, "reset.css", "reset")
+  stubFile(t, wd, "a.css", "a")
+  stubFile(t, wd, "b.css", "b")
+  stubFile(t, wd, "d.css", "d")
+
+  asset, err := newProcessed(background, srv, "/foo.css",
+                              filepath.Join(wd, "foo.css"))
+  if err != nil {
+    t.Fatalf("ran into error: %s", err.Error())
+  }
+  bits, err := ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "reset\n" + src + "\na\nb")
+}
+
+func TestHeaderDirectives(t *testing.T) {
+  src := "# comment\n#= require foo\n\n// x\n//=require_self\n" +
+         "/* block\n   *= require_tree . */\n#= require bar"
+  directives, err := headerDirectives(strings.NewReader(src), true)
+  check(t, err)
+  found := make([]string, 0)
+  for _, d := range directives {
+    found = append(found, strings.TrimSpace(d[1] + " " + d[2]))
+  }
+  testEq(t, strings.Join(found, ","),
+         "require foo,require_self,require_tree .,require bar")
+
+  directives, err = headerDirectives(strings.NewReader(src), false)
+  check(t, err)
+  if len(directives) != 0 {
+    t.Errorf("'#' shouldn't be a comment: %v", directives)
+  }
+}
+
+func TestProcessedSourceMap(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  srv.Config().SourceMaps = true
+  stubFile(t, wd, "foo.js", "//= require bar\nfoo")
+  stubFile(t, wd, "bar.js", "bar\nbar2")
+
+  asset, err := newProcessed(background, srv, "/foo.js",
+                              filepath.Join(wd, "foo.js"))
+  if err != nil {
+    t.Fatalf("ran into error: %s", err.Error())
+  }
+  bits, err := ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "bar\nbar2\n//= require bar\nfoo\n" +
+         "//# sourceMappingURL=foo-" + asset.Digest() + ".js.map\n")
+
+  bits, err = ioutil.ReadFile(asset.(mappedAsset).sourceMap())
+  check(t, err)
+  if !strings.Contains(string(bits), `"mappings":"AAAA;AACA;ACDA;AACA"`) ||
+     !strings.Contains(string(bits), `"sources":["/bar.js","/foo.js"]`) {
+    t.Errorf("wrong source map:\n%s", string(bits))
+  }
+}
+
+func TestProcessedCycle(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "a.js", "//= require b\na")
+  stubFile(t, wd, "b.js", "//= require c\nb")
+  stubFile(t, wd, "c.js", "//= require a\nc")
+
+  done := make(chan error)
+  go func() {
+    _, err := srv.Asset("b.js")
+    done <- err
+  }()
+  select {
+  case err := <-done:
+    cycle, ok := err.(*CycleError)
+    if !ok {
+      t.Fatalf("expected a cycle error, got %v", err)
+    }
+    testEq(t, strings.Join(cycle.Chain, " "), "/b.js /c.js /a.js /b.js")
+  case <-time.After(5 * time.Second):
+    t.Fatalf("deadlocked building a cycle")
+  }
+}
+
+func TestProcessedSharedDependency(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "app.js", "//= require a\n//= require b\napp")
+  stubFile(t, wd, "a.js", "//= require util\na")
+  stubFile(t, wd, "b.js", "//= require util\nb")
+  stubFile(t, wd, "util.js", "util")
+
+  asset, err := srv.Asset("app.js")
+  check(t, err)
+  bits, err := ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "util\n//= require util\na\n" +
+                          "//= require util\nb\n" +
+                          "//= require a\n//= require b\napp")
+}
+
+func TestLogicalName(t *testing.T) {
+  testEq(t, DefaultRegistry.logicalName("foo.js"), "foo.js")
+  testEq(t, DefaultRegistry.logicalName("foo.js.tmpl"), "foo.js")
+  testEq(t, DefaultRegistry.logicalName("a/foo.up"), "a/foo.css")
+  testEq(t, DefaultRegistry.logicalName("a/app.css.up.tmpl"), "a/app.css")
+  testEq(t, DefaultRegistry.logicalName("jquery.min.js.tmpl"), "jquery.min.js")
+  testEq(t, DefaultRegistry.logicalName("foo.tmpl"), "foo.tmpl")
+  /* types come from a fixed list, not the host's mime types */
+  testEq(t, DefaultRegistry.logicalName("notes.md.tmpl"), "notes.md")
+  testEq(t, DefaultRegistry.logicalName("foo.mml.tmpl"), "foo.mml.tmpl")
+}
+
+func TestProcessedStackedExtensions(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "app.css.up.tmpl", "{{name}}")
+  stubFile(t, wd, "foo.js.tmpl", "//= require bar\n{{name}}")
+  stubFile(t, wd, "bar.js.tmpl", "{{name}}")
+
+  /* the template has to be filled in before it's upcased */
+  asset, err := srv.Asset("app.css")
+  check(t, err)
+  bits, err := ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "PASTE")
+
+  asset, err = srv.Asset("foo.js")
+  check(t, err)
+  bits, err = ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "paste\n//= require bar\npaste")
+}
+
+func TestProcessedBodyReplaced(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "js/foo.js.tmpl", "a{{name}}")
+  _, err := newProcessed(background, srv, "/js/foo.js",
+                         filepath.Join(wd, "js/foo.js.tmpl"))
+  check(t, err)
+  stubFile(t, wd, "js/foo.js.tmpl", "bb{{name}}")
+  asset, err := newProcessed(background, srv, "/js/foo.js",
+                             filepath.Join(wd, "js/foo.js.tmpl"))
+  check(t, err)
+  bits, err := ioutil.ReadFile(asset.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "bbpaste")
+
+  /* rebuilding doesn't leave the old body behind */
+  tmp, err := srv.tempDir()
+  check(t, err)
+  entries, err := ioutil.ReadDir(filepath.Join(tmp, "body/js"))
+  check(t, err)
+  if len(entries) != 1 || entries[0].Name() != "foo.js" {
+    t.Errorf("expected just one body, found %d", len(entries))
+  }
+}
+
+func TestProcessedSharedTempDir(t *testing.T) {
+  tmpdir, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(tmpdir)
+  fsys := fstest.MapFS{
+    "admin/app.js": &fstest.MapFile{Data: []byte("//= require lib\nadmin")},
+    "admin/lib.js.tmpl": &fstest.MapFile{Data: []byte("admin {{name}}")},
+    "public/app.js": &fstest.MapFile{Data: []byte("//= require lib\npublic")},
+    "public/lib.js.tmpl": &fstest.MapFile{Data: []byte("public {{name}}")},
+  }
+
+  /* both servers build lib.js, but neither sees the other's */
+  admin := FileServer(Config{FS: fsys, Root: "admin",
+                             TempDir: tmpdir}).(*fileServer)
+  defer admin.Close()
+  public := FileServer(Config{FS: fsys, Root: "public",
+                              TempDir: tmpdir}).(*fileServer)
+  defer public.Close()
+  a, err := admin.Asset("app.js")
+  check(t, err)
+  b, err := public.Asset("app.js")
+  check(t, err)
+  bits, err := ioutil.ReadFile(a.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "admin paste\n//= require lib\nadmin")
+  bits, err = ioutil.ReadFile(b.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "public paste\n//= require lib\npublic")
+
+  /* closing a server cleans up after it */
+  tmp, err := admin.tempDir()
+  check(t, err)
+  check(t, admin.Close())
+  if _, err := os.Stat(tmp); err == nil {
+    t.Errorf("%s should have been removed", tmp)
+  }
+}
+
+func TestProcessedTimeout(t *testing.T) {
+  wd, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "foo.js.wait", "a")
+  stubFile(t, wd, "bar.js.hang", "a")
+
+  /* processors which know about contexts are cancelled, and those which
+     don't are given up on */
+  release := make(chan bool)
+  defer close(release)
+  registry := NewRegistry()
+  check(t, registry.RegisterProcessor(ContextProcessorFunc(
+    func(ctx context.Context, infile, outfile string) error {
+      <-ctx.Done()
+      return ctx.Err()
+    }), ".wait"))
+  check(t, registry.RegisterProcessor(ProcessorFunc(
+    func(infile, outfile string) error {
+      <-release
+      return nil
+    }), ".hang"))
+  srv := FileServer(Config{Root: wd, Registry: registry,
+                           ProcessTimeout: 10 * time.Millisecond})
+
+  for _, logical := range []string{"foo.js", "bar.js"} {
+    _, err = srv.Asset(logical)
+    if err == nil || !strings.Contains(err.Error(), "timed out") {
+      t.Errorf("expected %s to time out, got %v", logical, err)
+    }
+  }
+}
+
+func TestProcessedTimeoutPerExtension(t *testing.T) {
+  wd, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "foo.js.slow", "a")
+  stubFile(t, wd, "bar.js.wait", "a")
+
+  registry := NewRegistry()
+  check(t, registry.RegisterProcessor(ContextProcessorFunc(
+    func(ctx context.Context, infile, outfile string) error {
+      select {
+      case <-time.After(50 * time.Millisecond):
+        return ioutil.WriteFile(outfile, []byte("slow"), 0644)
+      case <-ctx.Done():
+        return ctx.Err()
+      }
+    }), ".slow"))
+  check(t, registry.RegisterProcessor(ContextProcessorFunc(
+    func(ctx context.Context, infile, outfile string) error {
+      <-ctx.Done()
+      return ctx.Err()
+    }), ".wait"))
+  registry.SetTimeout(".slow", time.Minute)
+  srv := FileServer(Config{Root: wd, Registry: registry,
+                           ProcessTimeout: 10 * time.Millisecond})
+
+  /* the extension's own timeout wins over the configuration's */
+  _, err = srv.Asset("foo.js")
+  check(t, err)
+  _, err = srv.Asset("bar.js")
+  if err == nil || !strings.Contains(err.Error(), "timed out") {
+    t.Errorf("expected bar.js to time out, got %v", err)
+  }
+  if registry.Clone().timeout(".slow", 0) != time.Minute {
+    t.Errorf("clones should have the same timeouts")
+  }
+}
+
+func TestProcessedCancelled(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "foo.js", "a")
+
+  ctx, cancel := context.WithCancel(background)
+  cancel()
+  if _, err := srv.AssetContext(ctx, "foo.js"); err != context.Canceled {
+    t.Errorf("expected the asset to be cancelled, got %v", err)
+  }
+  /* giving up on the asset doesn't stop it from being built later */
+  _, err := srv.Asset("foo.js")
+  check(t, err)
+}
@@ -0,0 +1,217 @@
+package paste
+
+import "errors"
+import "path"
+import "strings"
+import "sync"
+import "time"
+
+// A set of processors, compressors and aliases which a file server uses to
+// build assets. Servers use DefaultRegistry, which the package-level
+// 'Register*' functions modify, unless Config.Registry says otherwise. This
+// allows more than one server in a program to have different pipelines, and
+// tests to register processors without affecting anything else.
+//
+// It's safe to register more processors while a registry is in use, but assets
+// which have already been built won't be rebuilt because of it.
+type Registry struct {
+  processors  map[string]StreamProcessor
+  compressors map[string]StreamProcessor
+  aliases     map[string][]string
+  timeouts    map[string]time.Duration
+  sync.RWMutex
+}
+
+// The registry modified by RegisterProcessor, RegisterCompressor and friends,
+// and used by all servers which aren't configured with a registry of their own
+var DefaultRegistry = NewRegistry()
+
+// Creates a new empty registry
+func NewRegistry() *Registry {
+  return &Registry{ processors: make(map[string]StreamProcessor),
+                    compressors: make(map[string]StreamProcessor),
+                    aliases: make(map[string][]string),
+                    timeouts: make(map[string]time.Duration) }
+}
+
+// Returns a copy of this registry, which can then be modified independently.
+// For example DefaultRegistry.Clone() starts off with everything imported
+// packages have registered.
+func (r *Registry) Clone() *Registry {
+  r.RLock()
+  defer r.RUnlock()
+  ret := NewRegistry()
+  for ext, p := range r.processors {
+    ret.processors[ext] = p
+  }
+  for ext, p := range r.compressors {
+    ret.compressors[ext] = p
+  }
+  for ext, a := range r.aliases {
+    ret.aliases[ext] = append([]string{}, a...)
+  }
+  for ext, t := range r.timeouts {
+    ret.timeouts[ext] = t
+  }
+  return ret
+}
+
+// Registers a processor to run for the given extension whenever files are
+// processed, returning an error if one is already registered for it
+func (r *Registry) RegisterProcessor(p Processor, ext string) error {
+  return r.RegisterStreamProcessor(fileProcessor{p}, ext)
+}
+
+// Same as RegisterProcessor, except for processors which work on streams
+func (r *Registry) RegisterStreamProcessor(p StreamProcessor, ext string) error {
+  r.Lock()
+  defer r.Unlock()
+  if _, ok := r.processors[ext]; ok {
+    return errors.New("Processor already registered for " + ext)
+  }
+  r.processors[ext] = p
+  return nil
+}
+
+// Registers a compressor to run for the given extension whenever files are
+// compressed, returning an error if one is already registered for it
+func (r *Registry) RegisterCompressor(p Processor, ext string) error {
+  return r.RegisterStreamCompressor(fileProcessor{p}, ext)
+}
+
+// Same as RegisterCompressor, except for compressors which work on streams
+func (r *Registry) RegisterStreamCompressor(p StreamProcessor,
+                                            ext string) error {
+  r.Lock()
+  defer r.Unlock()
+  if _, ok := r.compressors[ext]; ok {
+    return errors.New("Compressor already registered for " + ext)
+  }
+  r.compressors[ext] = p
+  return nil
+}
+
+// Registers an alias from one extension to another, see RegisterAlias
+func (r *Registry) RegisterAlias(extension, alias string) {
+  r.Lock()
+  defer r.Unlock()
+  r.aliases[extension] = append(r.aliases[extension], alias)
+}
+
+// Limits how long the processor and compressor for the given extension may run
+// for when building an asset before they're cancelled, instead of the
+// ProcessTimeout of the server's configuration. Zero means no limit.
+//
+// Only processors which implement ContextProcessor (and stream processors
+// which watch their context) actually stop when they time out. Building the
+// asset fails either way, but others are left running in the background.
+func (r *Registry) SetTimeout(ext string, timeout time.Duration) {
+  r.Lock()
+  defer r.Unlock()
+  r.timeouts[ext] = timeout
+}
+
+// Returns how long the processors for an extension may run for, or 'fallback'
+// if no timeout was set for the extension
+func (r *Registry) timeout(ext string, fallback time.Duration) time.Duration {
+  r.RLock()
+  defer r.RUnlock()
+  if t, ok := r.timeouts[ext]; ok {
+    return t
+  }
+  return fallback
+}
+
+func (r *Registry) processor(ext string) (StreamProcessor, bool) {
+  r.RLock()
+  defer r.RUnlock()
+  p, ok := r.processors[ext]
+  return p, ok
+}
+
+func (r *Registry) compressor(ext string) (StreamProcessor, bool) {
+  r.RLock()
+  defer r.RUnlock()
+  p, ok := r.compressors[ext]
+  return p, ok
+}
+
+// Returns all extensions which are aliases of the given one
+func (r *Registry) aliasesOf(ext string) []string {
+  r.RLock()
+  defer r.RUnlock()
+  return append([]string{}, r.aliases[ext]...)
+}
+
+// If the extension is an alias for another extension, returns that extension,
+// otherwise returns the extension itself
+func (r *Registry) logicalExt(ext string) string {
+  r.RLock()
+  defer r.RUnlock()
+  for a, possibilities := range r.aliases {
+    for _, p := range possibilities {
+      if p == ext {
+        return a
+      }
+    }
+  }
+  return ext
+}
+
+// Extensions of the types of files which are usually assets. This is fixed
+// instead of coming from the mime package, which also reads the mime types of
+// the host, so that sources get the same logical names on every machine.
+var typeExts = map[string]bool{
+  ".avif": true, ".bmp": true, ".csv": true, ".css": true, ".eot": true,
+  ".gif": true, ".htm": true, ".html": true, ".ico": true, ".jpeg": true,
+  ".jpg": true, ".js": true, ".json": true, ".map": true, ".md": true,
+  ".mjs": true, ".mp3": true, ".mp4": true, ".ogg": true, ".otf": true,
+  ".pdf": true, ".png": true, ".svg": true, ".tif": true, ".tiff": true,
+  ".ttf": true, ".txt": true, ".wasm": true, ".wav": true, ".webm": true,
+  ".webp": true, ".woff": true, ".woff2": true, ".xml": true, ".zip": true,
+}
+
+// Returns whether an extension is one which says what type of file something
+// is, as opposed to an extension like the '.min' in 'jquery.min.js'. Only the
+// registry and a fixed list of types are consulted.
+func (r *Registry) knownExt(ext string) bool {
+  if ext == "" {
+    return false
+  }
+  _, ok := r.processor(ext)
+  return ok || len(r.aliasesOf(ext)) > 0 || r.logicalExt(ext) != ext ||
+         typeExts[strings.ToLower(ext)]
+}
+
+// Splits the base name of a source file into the processors which need to run
+// on it, in the order to run them, and the logical name of the file.
+//
+// Extensions are stacked, so 'app.css.scss.tmpl' is first run through the
+// processor for '.tmpl' and then the one for '.scss' to produce 'app.css'. If
+// stripping off an extension would leave a name without a known type, like
+// 'foo.scss' or 'jquery.min.js', the extension is mapped through its alias
+// instead.
+func (r *Registry) processorChain(name string) ([]StreamProcessor, string) {
+  chain := make([]StreamProcessor, 0)
+  for {
+    ext := path.Ext(name)
+    p, ok := r.processor(ext)
+    if !ok {
+      break
+    }
+    chain = append(chain, p)
+    base := name[:len(name) - len(ext)]
+    if !r.knownExt(path.Ext(base)) {
+      return chain, base + r.logicalExt(ext)
+    }
+    name = base
+  }
+  ext := path.Ext(name)
+  return chain, name[:len(name) - len(ext)] + r.logicalExt(ext)
+}
+
+// Returns the logical name of a slash-separated source file name
+func (r *Registry) logicalName(name string) string {
+  _, base := r.processorChain(path.Base(name))
+  return path.Join(path.Dir(name), base)
+}
@@ -0,0 +1,66 @@
+package paste
+
+import "io/ioutil"
+import "os"
+import "testing"
+
+func TestRegistryDuplicates(t *testing.T) {
+  r := NewRegistry()
+  check(t, r.RegisterProcessor(ProcessorFunc(fillTemplate), ".tmpl"))
+  if r.RegisterProcessor(ProcessorFunc(fillTemplate), ".tmpl") == nil {
+    t.Errorf("expected an error registering a processor twice")
+  }
+  check(t, r.RegisterCompressor(ProcessorFunc(fillTemplate), ".js"))
+  if r.RegisterCompressor(ProcessorFunc(fillTemplate), ".js") == nil {
+    t.Errorf("expected an error registering a compressor twice")
+  }
+}
+
+func TestRegistryClone(t *testing.T) {
+  r := DefaultRegistry.Clone()
+  if _, ok := r.processor(".tmpl"); !ok {
+    t.Errorf("clone should have the default processors")
+  }
+  check(t, r.RegisterProcessor(ProcessorFunc(fillTemplate), ".clone"))
+  if _, ok := DefaultRegistry.processor(".clone"); ok {
+    t.Errorf("registering on a clone shouldn't affect the original")
+  }
+}
+
+func TestRegistryPerServer(t *testing.T) {
+  wd, err := ioutil.TempDir("", "paste")
+  check(t, err)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "foo.js.tmpl", "{{name}}")
+
+  plain := FileServer(Config{Root: wd, Registry: NewRegistry()})
+  _, err = plain.Asset("foo.js")
+  if err == nil {
+    t.Errorf("foo.js shouldn't exist without a processor for .tmpl")
+  }
+  a, err := plain.Asset("foo.js.tmpl")
+  check(t, err)
+  bits, err := ioutil.ReadFile(a.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "{{name}}")
+
+  registry := NewRegistry()
+  check(t, registry.RegisterStreamProcessor(StreamProcessorFunc(upcase),
+                                            ".tmpl"))
+  custom := FileServer(Config{Root: wd, Registry: registry})
+  a, err = custom.Asset("foo.js")
+  check(t, err)
+
+  /* building the same source with another registry doesn't clobber what the
+     first one built, even though they share a TempDir */
+  other := NewRegistry()
+  check(t, other.RegisterProcessor(ProcessorFunc(fillTemplate), ".tmpl"))
+  b, err := FileServer(Config{Root: wd, Registry: other}).Asset("foo.js")
+  check(t, err)
+  bits, err = ioutil.ReadFile(b.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "paste")
+  bits, err = ioutil.ReadFile(a.Pathname())
+  check(t, err)
+  testEq(t, string(bits), "{{NAME}}")
+}
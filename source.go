@@ -0,0 +1,283 @@
+package paste
+
+import "io/fs"
+import "io/ioutil"
+import "os"
+import "path"
+import "path/filepath"
+import "sort"
+import "strings"
+import "sync/atomic"
+
+// Implemented by assets whose files may not live on the OS filesystem. The
+// name is either the pathname of the asset or of one of its encoded copies.
+type openableAsset interface {
+  open(name string) (fs.File, error)
+}
+
+// Returns the actual asset behind one returned by a file server
+func unwrap(a Asset) Asset {
+  if m, ok := a.(*assetMeta); ok {
+    return m.Asset
+  }
+  return a
+}
+
+// Opens a file of an asset, going through wherever the asset's files actually
+// live
+func openAsset(a Asset, name string) (fs.File, error) {
+  if o, ok := unwrap(a).(openableAsset); ok {
+    return o.open(name)
+  }
+  return os.Open(name)
+}
+
+// All names of source files are either pathnames on the OS filesystem or, if a
+// filesystem is configured, slash-separated names within that filesystem. These
+// helpers paper over the difference.
+
+func (s *fileServer) open(name string) (fs.File, error) {
+  if s.config.FS == nil {
+    return os.Open(name)
+  }
+  return s.config.FS.Open(name)
+}
+
+func (s *fileServer) stat(name string) (fs.FileInfo, error) {
+  if s.config.FS == nil {
+    return os.Stat(name)
+  }
+  return fs.Stat(s.config.FS, name)
+}
+
+func (s *fileServer) openStat(name string) (fs.File, fs.FileInfo, error) {
+  f, err := s.open(name)
+  if err != nil { return nil, nil, err }
+  stat, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return nil, nil, err
+  }
+  return f, stat, nil
+}
+
+// Returns the registry of processors this server builds assets with
+func (s *fileServer) registry() *Registry {
+  if s.config.Registry == nil {
+    return DefaultRegistry
+  }
+  return s.config.Registry
+}
+
+// Returns the directory to put files built by this server in. Files are named
+// after the assets they're built for, and servers sharing a TempDir (even in
+// other processes) may have other sources or processors for the same names, so
+// each server gets a directory of its own.
+func (s *fileServer) tempDir() (string, error) {
+  s.tmpLock.Lock()
+  defer s.tmpLock.Unlock()
+  if s.tmpdir == "" {
+    if err := os.MkdirAll(s.config.TempDir, 0755); err != nil {
+      return "", err
+    }
+    dir, err := ioutil.TempDir(s.config.TempDir, "server")
+    if err != nil { return "", err }
+    s.tmpdir = dir
+  }
+  return s.tmpdir, nil
+}
+
+// Returns all locations which assets are searched for in, in order
+func (s *fileServer) roots() []string {
+  return append([]string{s.config.Root}, s.config.Paths...)
+}
+
+// Returns the name of the source file for a logical path in the given root
+func (s *fileServer) sourceName(root, logical string) string {
+  if s.config.FS == nil {
+    return filepath.Join(root, logical)
+  }
+  return path.Join(root, logical)
+}
+
+// Inverse of sourceName(), returns the slash-separated path of a source file
+// relative to the root it's in, without a leading slash.
+func (s *fileServer) relativeName(name string) string {
+  for _, root := range s.roots() {
+    if rel, ok := s.relativeTo(root, name); ok {
+      return rel
+    }
+  }
+  return filepath.ToSlash(name)
+}
+
+// Returns the slash-separated path of a source file relative to the given
+// root, or false if the file isn't in that root
+func (s *fileServer) relativeTo(root, name string) (string, bool) {
+  if s.config.FS == nil {
+    rel, err := filepath.Rel(root, name)
+    if err != nil || strings.HasPrefix(rel, "..") {
+      return "", false
+    }
+    return filepath.ToSlash(rel), true
+  } else if root == "." {
+    return name, true
+  } else if strings.HasPrefix(name, root + "/") {
+    return name[len(root) + 1:], true
+  }
+  return "", false
+}
+
+// Lists the contents of a logical directory, which is the combination of that
+// directory in all roots. Entries are sorted by name, and if more than one
+// root has an entry of the same name, the first one wins.
+func (s *fileServer) readDir(logical string) ([]fs.DirEntry, error) {
+  var err error
+  found := false
+  seen := make(map[string]bool)
+  ret := make([]fs.DirEntry, 0)
+  for _, root := range s.roots() {
+    var entries []fs.DirEntry
+    entries, err = s.readRootDir(root, logical)
+    if err != nil {
+      continue
+    }
+    found = true
+    for _, entry := range entries {
+      if !seen[entry.Name()] {
+        seen[entry.Name()] = true
+        ret = append(ret, entry)
+      }
+    }
+  }
+  if !found {
+    return nil, err
+  }
+  sort.Slice(ret, func(i, j int) bool { return ret[i].Name() < ret[j].Name() })
+  return ret, nil
+}
+
+// Cached listing of a directory
+type dirListing struct {
+  entries []fs.DirEntry
+  err     error
+}
+
+// Lists the contents of a logical directory in just one root, sorted by name.
+// Ignored files aren't listed. When watching for changes, listings are cached
+// until something changes, so looking for assets which don't exist doesn't
+// hit the filesystem every time. The returned slice must not be modified.
+func (s *fileServer) readRootDir(root, logical string) ([]fs.DirEntry, error) {
+  name := s.sourceName(root, logical)
+  generation := atomic.LoadUint64(&s.generation)
+  if s.watcher != nil {
+    s.listingsLock.Lock()
+    l, ok := s.listings[name]
+    ok = ok && s.listingsGeneration == generation
+    s.listingsLock.Unlock()
+    if ok {
+      return l.entries, l.err
+    }
+  }
+
+  var entries []fs.DirEntry
+  var err error
+  if s.config.FS == nil {
+    entries, err = os.ReadDir(name)
+  } else {
+    entries, err = fs.ReadDir(s.config.FS, name)
+  }
+  ret := entries[:0]
+  for _, entry := range entries {
+    if !s.ignored(root, path.Join(logical, entry.Name())) {
+      ret = append(ret, entry)
+    }
+  }
+
+  if s.watcher != nil {
+    s.listingsLock.Lock()
+    if s.listings == nil || s.listingsGeneration != generation {
+      /* anything listed in another generation is out of date */
+      s.listings = make(map[string]*dirListing)
+      s.listingsGeneration = generation
+    }
+    s.listings[name] = &dirListing{ ret, err }
+    s.listingsLock.Unlock()
+  }
+  return ret, err
+}
+
+// Patterns of source files which are always ignored: dotfiles, along with the
+// swap and backup files which editors leave lying around
+var defaultIgnore = []string{".*", "*~", "*.swp", "#*#"}
+
+// Tests whether a source file, given as a slash-separated path relative to
+// the root it's in, should be pretended to not exist. That's everything in
+// TempDir and everything matching either Config.Ignore or defaultIgnore.
+func (s *fileServer) ignored(root, rel string) bool {
+  rel = strings.TrimPrefix(path.Clean("/" + rel), "/")
+  if rel == "" {
+    return false
+  }
+  if s.config.FS == nil {
+    name := filepath.Join(root, filepath.FromSlash(rel))
+    tmp, err := filepath.Rel(s.config.TempDir, name)
+    if err == nil && !strings.HasPrefix(tmp, "..") {
+      return true
+    }
+  }
+
+  /* Patterns without a slash match any one component of the path, and others
+     match either the whole path or a directory it's in */
+  parts := strings.Split(rel, "/")
+  for _, patterns := range [][]string{defaultIgnore, s.config.Ignore} {
+    for _, pattern := range patterns {
+      slash := strings.Contains(pattern, "/")
+      pattern = strings.TrimPrefix(pattern, "/")
+      for i, part := range parts {
+        if slash {
+          part = strings.Join(parts[:i + 1], "/")
+        }
+        if ok, _ := path.Match(pattern, part); ok {
+          return true
+        }
+      }
+    }
+  }
+  return false
+}
+
+// Invokes 'f' with the name of every source file under all roots, along with
+// the root that it was found in. Ignored files and directories are skipped.
+func (s *fileServer) walk(f func(root, name string) error) error {
+  for _, root := range s.roots() {
+    visit := func(name string, dir bool) error {
+      if rel, _ := s.relativeTo(root, name); s.ignored(root, rel) {
+        if dir {
+          return filepath.SkipDir
+        }
+        return nil
+      }
+      if dir { return nil }
+      return f(root, name)
+    }
+    var err error
+    if s.config.FS == nil {
+      err = filepath.Walk(root,
+                          func(name string, info os.FileInfo, err error) error {
+        if err != nil { return err }
+        return visit(name, info.IsDir())
+      })
+    } else {
+      err = fs.WalkDir(s.config.FS, root,
+                       func(name string, d fs.DirEntry, err error) error {
+        if err != nil { return err }
+        return visit(name, d.IsDir())
+      })
+    }
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
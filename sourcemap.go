@@ -0,0 +1,119 @@
+package paste
+
+import "encoding/json"
+import "strings"
+
+// A source map (version 3) being built up as a generated file is written. Each
+// chunk of text written is either mapped line-by-line to a source file, or is
+// unmapped (like separators between files).
+type sourceMap struct {
+  sources  []string
+  contents []string
+  lines    [][]mapping  // the mappings for each generated line
+  col      int          // column in the last generated line
+}
+
+type mapping struct {
+  col    int  // column in the generated line
+  source int  // index into sources
+  line   int  // line in the source
+}
+
+const base64Digits =
+  "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// Records that 'generated', the entire contents of the source file 'name', was
+// written to the generated file. If the contents were rewritten on the way,
+// like url() references in stylesheets, 'content' is what the source file
+// actually contains. Rewriting mustn't move lines around.
+func (m *sourceMap) addSource(name, content, generated string) {
+  source := len(m.sources)
+  m.sources = append(m.sources, name)
+  m.contents = append(m.contents, content)
+  for i, line := range strings.Split(generated, "\n") {
+    if i > 0 {
+      m.newline()
+    }
+    if line != "" {
+      m.current(mapping{ col: m.col, source: source, line: i })
+    }
+    m.col += len(line)
+  }
+}
+
+// Records that 'content' which didn't come from any source was written
+func (m *sourceMap) addUnmapped(content string) {
+  for i, line := range strings.Split(content, "\n") {
+    if i > 0 {
+      m.newline()
+    }
+    m.col += len(line)
+  }
+}
+
+func (m *sourceMap) current(mp mapping) {
+  if len(m.lines) == 0 {
+    m.lines = append(m.lines, nil)
+  }
+  m.lines[len(m.lines) - 1] = append(m.lines[len(m.lines) - 1], mp)
+}
+
+func (m *sourceMap) newline() {
+  if len(m.lines) == 0 {
+    m.lines = append(m.lines, nil)
+  }
+  m.lines = append(m.lines, nil)
+  m.col = 0
+}
+
+// Encodes the source map as JSON for the generated file named 'file'
+func (m *sourceMap) encode(file string) ([]byte, error) {
+  var mappings []byte
+  source, line := 0, 0
+  for i, segments := range m.lines {
+    if i > 0 {
+      mappings = append(mappings, ';')
+    }
+    col := 0
+    for j, mp := range segments {
+      if j > 0 {
+        mappings = append(mappings, ',')
+      }
+      /* every segment maps to column 0 of a source line */
+      mappings = appendVLQ(mappings, mp.col - col)
+      mappings = appendVLQ(mappings, mp.source - source)
+      mappings = appendVLQ(mappings, mp.line - line)
+      mappings = appendVLQ(mappings, 0)
+      col, source, line = mp.col, mp.source, mp.line
+    }
+  }
+
+  return json.Marshal(struct {
+    Version        int      `json:"version"`
+    File           string   `json:"file"`
+    Sources        []string `json:"sources"`
+    SourcesContent []string `json:"sourcesContent"`
+    Names          []string `json:"names"`
+    Mappings       string   `json:"mappings"`
+  }{ 3, file, append([]string{}, m.sources...),
+     append([]string{}, m.contents...), []string{}, string(mappings) })
+}
+
+// Appends the base64 VLQ encoding of 'n' to 'buf'
+func appendVLQ(buf []byte, n int) []byte {
+  v := n << 1
+  if n < 0 {
+    v = (-n << 1) | 1
+  }
+  for {
+    digit := v & 31
+    v >>= 5
+    if v > 0 {
+      digit |= 32
+    }
+    buf = append(buf, base64Digits[digit])
+    if v == 0 {
+      return buf
+    }
+  }
+}
@@ -0,0 +1,32 @@
+package paste
+
+import "encoding/json"
+import "testing"
+
+func TestVLQ(t *testing.T) {
+  for n, expected := range map[int]string{0: "A", 1: "C", -1: "D", 15: "e",
+                                          16: "gB", 123: "2H", -123: "3H"} {
+    testEq(t, string(appendVLQ(nil, n)), expected)
+  }
+}
+
+func TestSourceMap(t *testing.T) {
+  m := &sourceMap{}
+  m.addSource("/a.js", "a1\na2", "a1\na2")
+  m.addUnmapped("\n")
+  m.addSource("/b.js", "b1\n\nb3", "b1\n\nb3")
+
+  bits, err := m.encode("out.js")
+  check(t, err)
+  var decoded struct {
+    File           string
+    Sources        []string
+    SourcesContent []string
+    Mappings       string
+  }
+  check(t, json.Unmarshal(bits, &decoded))
+  testEq(t, decoded.File, "out.js")
+  testEq(t, decoded.Sources[0] + "," + decoded.Sources[1], "/a.js,/b.js")
+  testEq(t, decoded.SourcesContent[1], "b1\n\nb3")
+  testEq(t, decoded.Mappings, "AAAA;AACA;ACDA;;AAEA")
+}
@@ -1,12 +1,14 @@
 package paste
 
 import "errors"
+import "io/fs"
 import "time"
 
 type staticAsset struct {
   digest string
   pathname string
   mtime time.Time
+  size int64
   logical string
   srv *fileServer
 }
@@ -16,9 +18,13 @@ func (s *staticAsset) Pathname() string { return s.pathname }
 func (s *staticAsset) ModTime() time.Time { return s.mtime }
 func (s *staticAsset) LogicalName() string { return s.logical }
 
+func (s *staticAsset) open(name string) (fs.File, error) {
+  return s.srv.open(name)
+}
+
 func (s *staticAsset) Stale() bool {
   /* If the file doesn't exist, we're definitely stale */
-  f, stat, err := openStat(s.pathname)
+  f, stat, err := s.srv.openStat(s.pathname)
   if err != nil { return true }
   defer f.Close()
 
@@ -28,7 +34,7 @@ func (s *staticAsset) Stale() bool {
   }
 
   /* Same contents? not stale */
-  if hexdigest(s.srv, f) == s.digest {
+  if digest, err := hexdigest(s.srv, f); err == nil && digest == s.digest {
     return false
   }
 
@@ -38,15 +44,21 @@ func (s *staticAsset) Stale() bool {
 
 func newStatic(s *fileServer, logical, path string) (*staticAsset, error) {
   asset := &staticAsset { pathname: path, logical: logical, srv: s }
-  f, stat, err := openStat(path)
+  f, stat, err := s.openStat(path)
   if err != nil {
     return nil, err
-  } else if stat.IsDir() {
+  }
+  defer f.Close()
+  if stat.IsDir() {
     return nil, errors.New("cannot serve a directory")
   }
 
   asset.mtime = stat.ModTime()
-  asset.digest = hexdigest(s, f)
+  asset.size = stat.Size()
+  asset.digest, err = hexdigest(s, f)
+  if err != nil {
+    return nil, err
+  }
 
   return asset, nil
 }
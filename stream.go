@@ -0,0 +1,156 @@
+package paste
+
+import "context"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync"
+import "time"
+
+// Information about the asset a stream processor is running for
+type AssetInfo struct {
+  // Logical name of the asset being built, like '/css/app.css'
+  LogicalName string
+
+  // Name of the source file of the asset. This is a pathname on the OS
+  // filesystem unless the assets come from a Config.FS.
+  Pathname string
+
+  // Base name of what the processor is given. For stacked extensions this is
+  // the source's name with the extensions of earlier stages stripped off, like
+  // 'app.css.scss' for the second stage of 'app.css.scss.tmpl'.
+  Name string
+
+  // Extension of what the processor is expected to produce, like '.css'
+  Ext string
+}
+
+// A processor which reads its input from a reader and writes its output to a
+// writer instead of going through files, so stages of processing can be piped
+// together in memory.
+type StreamProcessor interface {
+  // Reads the input of the asset from 'r' and writes the processed output to
+  // 'w', returning any error encountered along the way. Processing should stop
+  // early if the context is cancelled.
+  ProcessStream(ctx context.Context, r io.Reader, w io.Writer,
+                info AssetInfo) error
+}
+
+// Easy way of implementing a stream processor as just a function
+type StreamProcessorFunc func(ctx context.Context, r io.Reader, w io.Writer,
+                              info AssetInfo) error
+
+func (p StreamProcessorFunc) ProcessStream(ctx context.Context, r io.Reader,
+                                           w io.Writer, info AssetInfo) error {
+  return p(ctx, r, w, info)
+}
+
+// Adapts a file-based processor to a stream processor. The input only has to
+// be copied into a file if it's not a file already.
+//
+// Processors which don't know about contexts can't be stopped, so they're left
+// running in the background if the context is cancelled (see
+// ContextProcessor).
+type fileProcessor struct {
+  Processor
+}
+
+func (p fileProcessor) ProcessStream(ctx context.Context, r io.Reader,
+                                     w io.Writer, info AssetInfo) error {
+  var infile string
+  if f, ok := r.(*os.File); ok {
+    infile = f.Name()
+  } else {
+    in, err := ioutil.TempFile("", "paste*" + filepath.Ext(info.Name))
+    if err != nil { return err }
+    defer os.Remove(in.Name())
+    _, err = io.Copy(in, r)
+    in.Close()
+    if err != nil { return err }
+    infile = in.Name()
+  }
+
+  out, err := ioutil.TempFile("", "paste*" + info.Ext)
+  if err != nil { return err }
+  out.Close()
+  defer os.Remove(out.Name())
+  if c, ok := p.Processor.(ContextProcessor); ok {
+    err = c.ProcessContext(ctx, infile, out.Name())
+  } else {
+    done := make(chan error, 1)
+    go func() { done <- p.Process(infile, out.Name()) }()
+    select {
+    case err = <-done:
+    case <-ctx.Done():
+      err = ctx.Err()
+    }
+  }
+  if err != nil {
+    return err
+  }
+  out, err = os.Open(out.Name())
+  if err != nil { return err }
+  defer out.Close()
+  _, err = io.Copy(w, out)
+  return err
+}
+
+// One stage of processing an asset, which is cancelled if it takes longer
+// than the timeout (unless it's zero)
+type stage struct {
+  processor StreamProcessor
+  info      AssetInfo
+  timeout   time.Duration
+}
+
+// Runs all stages one after another, connecting them with in-memory pipes.
+// Each stage but the last runs in its own goroutine. The first error from the
+// earliest stage is returned.
+func pipeline(ctx context.Context, stages []stage, r io.Reader,
+              w io.Writer) error {
+  run := func(st stage, r io.Reader, w io.Writer) error {
+    if st.timeout <= 0 {
+      return st.processor.ProcessStream(ctx, r, w, st.info)
+    }
+    sctx, cancel := context.WithTimeout(ctx, st.timeout)
+    defer cancel()
+    err := st.processor.ProcessStream(sctx, r, w, st.info)
+    if err != nil && ctx.Err() == nil && sctx.Err() != nil {
+      return fmt.Errorf("processing %s timed out after %v", st.info.Name,
+                        st.timeout)
+    }
+    return err
+  }
+  errs := make([]error, len(stages))
+  var wg sync.WaitGroup
+  for i, st := range stages[:len(stages) - 1] {
+    pr, pw := io.Pipe()
+    wg.Add(1)
+    go func(i int, st stage, in io.Reader) {
+      defer wg.Done()
+      errs[i] = run(st, in, pw)
+      pw.CloseWithError(errs[i])
+      if p, ok := in.(*io.PipeReader); ok {
+        p.Close()
+      }
+    }(i, st, r)
+    r = pr
+  }
+  last := stages[len(stages) - 1]
+  errs[len(stages) - 1] = run(last, r, w)
+  /* unblock earlier stages if this one didn't read everything */
+  if p, ok := r.(*io.PipeReader); ok {
+    p.Close()
+  }
+  wg.Wait()
+
+  for _, err := range errs {
+    if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+      return err
+    }
+  }
+  return nil
+}
@@ -0,0 +1,69 @@
+package paste
+
+import "bytes"
+import "context"
+import "errors"
+import "io"
+import "io/ioutil"
+import "strings"
+import "testing"
+
+func streamStage(f func(r io.Reader, w io.Writer) error) stage {
+  return stage{processor: StreamProcessorFunc(func(ctx context.Context,
+                                                   r io.Reader, w io.Writer,
+                                                   info AssetInfo) error {
+    return f(r, w)
+  })}
+}
+
+func TestPipeline(t *testing.T) {
+  upper := streamStage(func(r io.Reader, w io.Writer) error {
+    bits, err := ioutil.ReadAll(r)
+    if err != nil { return err }
+    _, err = w.Write(bytes.ToUpper(bits))
+    return err
+  })
+  double := streamStage(func(r io.Reader, w io.Writer) error {
+    bits, err := ioutil.ReadAll(r)
+    if err != nil { return err }
+    _, err = w.Write(append(bits, bits...))
+    return err
+  })
+  var out bytes.Buffer
+  check(t, pipeline(context.Background(), []stage{upper, double},
+                    strings.NewReader("ab"), &out))
+  testEq(t, out.String(), "ABAB")
+}
+
+func TestPipelineErrors(t *testing.T) {
+  failed := errors.New("failed")
+  fail := streamStage(func(r io.Reader, w io.Writer) error { return failed })
+  pass := streamStage(func(r io.Reader, w io.Writer) error {
+    _, err := io.Copy(w, r)
+    return err
+  })
+  /* writes more than fits in a pipe, so the next stage bailing out early
+     mustn't leave it blocked */
+  spew := streamStage(func(r io.Reader, w io.Writer) error {
+    _, err := w.Write(make([]byte, 1 << 20))
+    return err
+  })
+
+  for _, stages := range [][]stage{{fail, pass}, {pass, fail},
+                                   {spew, fail, pass}, {pass, spew, fail}} {
+    err := pipeline(context.Background(), stages, strings.NewReader("a"),
+                    ioutil.Discard)
+    if err != failed {
+      t.Errorf("expected the failure, got %v", err)
+    }
+  }
+}
+
+func TestFileProcessorAdapter(t *testing.T) {
+  var out bytes.Buffer
+  p := fileProcessor{ProcessorFunc(fillTemplate)}
+  check(t, p.ProcessStream(context.Background(),
+                           strings.NewReader("{{name}}!"), &out,
+                           AssetInfo{Name: "foo.js.tmpl", Ext: ".js"}))
+  testEq(t, out.String(), "paste!")
+}
@@ -0,0 +1,103 @@
+package paste
+
+import "html/template"
+import "path"
+import "strings"
+
+// Returns functions for html/template which generate URLs and tags for the
+// assets of a server:
+//
+//    asset_path "foo.png"              - URL of the asset
+//    javascript_include_tag "app"      - <script> tag for app.js
+//    stylesheet_link_tag "app"         - <link> tag for app.css
+//    image_tag "logo.png" "Some logo"  - <img> tag, the alt text is optional
+//
+// URLs are whatever the server's AssetPath returns prefixed with
+// Config.URLPrefix, so they only have digests in them when serving compiled
+// assets. A FileServer checks for changes on every request instead, so its URLs
+// don't need them. Script and link tags get integrity attributes if
+// Config.SubresourceIntegrity is set, and crossorigin attributes if
+// Config.CrossOrigin is set. If an asset can't be found or built, the error is
+// returned from the function, so executing the template fails.
+//
+// Example:
+//
+//    tmpl := template.New("page").Funcs(paste.FuncMap(srv))
+//    tmpl.Parse(`<head>{{ javascript_include_tag "app" }}</head>`)
+func FuncMap(srv Server) template.FuncMap {
+  h := &helpers{srv}
+  return template.FuncMap{
+    "asset_path":             h.assetPath,
+    "javascript_include_tag": h.javascriptIncludeTag,
+    "stylesheet_link_tag":    h.stylesheetLinkTag,
+    "image_tag":              h.imageTag,
+  }
+}
+
+type helpers struct {
+  srv Server
+}
+
+func (h *helpers) url(logical string) (string, error) {
+  p, err := h.srv.AssetPath(logical)
+  if err != nil { return "", err }
+  prefix := strings.TrimSuffix(h.srv.Config().URLPrefix, "/")
+  return prefix + p, nil
+}
+
+func (h *helpers) assetPath(logical string) (template.URL, error) {
+  url, err := h.url(logical)
+  return template.URL(url), err
+}
+
+// Builds a tag for an asset, with the URL of the asset in the attribute 'src'
+// and the integrity and crossorigin attributes if the configuration wants them
+func (h *helpers) tag(name, src, logical string, sri bool,
+                      attrs ...string) (template.HTML, error) {
+  url, err := h.url(logical)
+  if err != nil { return "", err }
+  attrs = append([]string{src, url}, attrs...)
+  config := h.srv.Config()
+  if sri && config.SubresourceIntegrity {
+    integrity, err := h.srv.Integrity(logical)
+    if err != nil { return "", err }
+    attrs = append(attrs, "integrity", integrity)
+  }
+  if sri && config.CrossOrigin != "" {
+    attrs = append(attrs, "crossorigin", config.CrossOrigin)
+  }
+
+  var b strings.Builder
+  b.WriteString("<" + name)
+  for i := 0; i < len(attrs); i += 2 {
+    b.WriteString(" " + attrs[i] + `="`)
+    b.WriteString(template.HTMLEscapeString(attrs[i + 1]) + `"`)
+  }
+  b.WriteString(">")
+  if name == "script" {
+    b.WriteString("</script>")
+  }
+  return template.HTML(b.String()), nil
+}
+
+// Assumes the given extension if the logical name doesn't have one
+func withExt(logical, ext string) string {
+  if path.Ext(logical) == "" {
+    return logical + ext
+  }
+  return logical
+}
+
+func (h *helpers) javascriptIncludeTag(logical string) (template.HTML, error) {
+  return h.tag("script", "src", withExt(logical, ".js"), true)
+}
+
+func (h *helpers) stylesheetLinkTag(logical string) (template.HTML, error) {
+  return h.tag("link", "href", withExt(logical, ".css"), true,
+               "rel", "stylesheet")
+}
+
+func (h *helpers) imageTag(logical string,
+                           alt ...string) (template.HTML, error) {
+  return h.tag("img", "src", logical, false, "alt", strings.Join(alt, " "))
+}
@@ -0,0 +1,80 @@
+package paste
+
+import "html/template"
+import "os"
+import "strings"
+import "testing"
+
+func render(t *testing.T, srv Server, text string) (string, error) {
+  tmpl, err := template.New("test").Funcs(FuncMap(srv)).Parse(text)
+  check(t, err)
+  var b strings.Builder
+  err = tmpl.Execute(&b, nil)
+  return b.String(), err
+}
+
+func TestFuncMap(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "app.js", "a")
+  stubFile(t, wd, "app.css", "b")
+  stubFile(t, wd, "logo.png", "c")
+  srv.config.URLPrefix = "/assets/"
+
+  out, err := render(t, srv, `<a href="{{ asset_path "logo.png" }}">`)
+  check(t, err)
+  testEq(t, out, `<a href="/assets/logo.png">`)
+
+  out, err = render(t, srv, `{{ javascript_include_tag "app" }}`)
+  check(t, err)
+  testEq(t, out, `<script src="/assets/app.js"></script>`)
+
+  out, err = render(t, srv, `{{ stylesheet_link_tag "app.css" }}`)
+  check(t, err)
+  testEq(t, out, `<link href="/assets/app.css" rel="stylesheet">`)
+
+  out, err = render(t, srv, `{{ image_tag "logo.png" "A <logo>" }}`)
+  check(t, err)
+  testEq(t, out, `<img src="/assets/logo.png" alt="A &lt;logo&gt;">`)
+}
+
+func TestFuncMapIntegrity(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  stubFile(t, wd, "app.js", "a")
+  srv.config.SubresourceIntegrity = true
+  srv.config.CrossOrigin = "anonymous"
+
+  integrity, err := srv.Integrity("app.js")
+  check(t, err)
+  out, err := render(t, srv, `{{ javascript_include_tag "app" }}`)
+  check(t, err)
+  testEq(t, out, `<script src="/app.js" integrity="` +
+                 integrity + `" crossorigin="anonymous"></script>`)
+}
+
+func TestFuncMapErrors(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+
+  for _, text := range []string{`{{ asset_path "missing.png" }}`,
+                                `{{ javascript_include_tag "missing" }}`,
+                                `{{ stylesheet_link_tag "missing" }}`,
+                                `{{ image_tag "missing.png" }}`} {
+    if _, err := render(t, srv, text); err == nil {
+      t.Errorf("expected an error rendering %s", text)
+    }
+  }
+}
+
+func TestFuncMapCompiled(t *testing.T) {
+  srv, dst := stubCompiledServer(t)
+  defer os.RemoveAll(dst)
+  asset, err := srv.Asset("foo.css")
+  check(t, err)
+
+  out, err := render(t, srv, `{{ stylesheet_link_tag "foo" }}`)
+  check(t, err)
+  testEq(t, out, `<link href="/foo-` + asset.Digest() +
+                 `.css" rel="stylesheet">`)
+}
@@ -1,33 +1,88 @@
 package paste
 
-import "crypto/md5"
+import "crypto"
+import _ "crypto/md5"
 import "encoding/hex"
+import "errors"
+import "fmt"
+import "hash"
 import "io"
-import "os"
+import "regexp"
+import "sync"
 
-func hexdigest(srv *fileServer, f io.Reader) string {
-  hash := md5.New()
-  hash.Write([]byte(Version))
-  hash.Write([]byte(srv.config.Version))
-  io.Copy(hash, f)
-  return hex.EncodeToString(hash.Sum(nil))
+// Returns the hash which digests of assets are computed with
+func (c *Config) digestHash() crypto.Hash {
+  if c.DigestHash == 0 {
+    return crypto.MD5
+  }
+  return c.DigestHash
 }
 
-func hexdigestString(srv *fileServer, s string) string {
-  hash := md5.New()
+// Shortest digest allowed, see Config.DigestLength
+const minDigestLength = 8
+
+// Returns how many hex characters of the hash digests are truncated to
+func (c *Config) digestLength() int {
+  full := hex.EncodedLen(c.digestHash().Size())
+  if c.DigestLength <= 0 || c.DigestLength > full {
+    return full
+  } else if c.DigestLength < minDigestLength && full > minDigestLength {
+    return minDigestLength
+  }
+  return c.DigestLength
+}
+
+func newDigest(srv *fileServer) (hash.Hash, error) {
+  h := srv.config.digestHash()
+  if !h.Available() {
+    return nil, errors.New(fmt.Sprintf("digest hash %v isn't available, the " +
+                                       "package implementing it needs to " +
+                                       "be imported", h))
+  }
+  hash := h.New()
   hash.Write([]byte(Version))
   hash.Write([]byte(srv.config.Version))
+  return hash, nil
+}
+
+func hexdigest(srv *fileServer, f io.Reader) (string, error) {
+  hash, err := newDigest(srv)
+  if err != nil { return "", err }
+  if _, err = io.Copy(hash, f); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(hash.Sum(nil))[:srv.config.digestLength()], nil
+}
+
+func hexdigestString(srv *fileServer, s string) (string, error) {
+  hash, err := newDigest(srv)
+  if err != nil { return "", err }
   hash.Write([]byte(s))
-  return hex.EncodeToString(hash.Sum(nil))
+  return hex.EncodeToString(hash.Sum(nil))[:srv.config.digestLength()], nil
+}
+
+// Regexes for finding the hash in a requested filename (if any), by the number
+// of characters in the hash
+var hashRegexes = make(map[int]*regexp.Regexp)
+var hashRegexLock sync.Mutex
+
+func hashRegex(length int) *regexp.Regexp {
+  hashRegexLock.Lock()
+  defer hashRegexLock.Unlock()
+  r, ok := hashRegexes[length]
+  if !ok {
+    r = regexp.MustCompile(fmt.Sprintf(`^(.*)-([a-f0-9]{%d})(\.\w+)$`, length))
+    hashRegexes[length] = r
+  }
+  return r
 }
 
-func openStat(path string) (*os.File, os.FileInfo, error) {
-  f, err := os.Open(path)
-  if err != nil { return nil, nil, err }
-  stat, err := f.Stat()
-  if err != nil {
-    f.Close()
-    return nil, nil, err
+// Looks up a hash by what its String() method returns, like "SHA-256"
+func hashByName(name string) (crypto.Hash, bool) {
+  for h := crypto.MD4; h <= crypto.BLAKE2b_512; h++ {
+    if h.String() == name {
+      return h, true
+    }
   }
-  return f, stat, nil
+  return 0, false
 }
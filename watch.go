@@ -0,0 +1,258 @@
+package paste
+
+import "io/fs"
+import "os"
+import "path"
+import "path/filepath"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Something which notices changes to the sources of a file server. Whenever
+// files change, the 'changed' function of the server is invoked with their
+// names, or with nil if it's unknown what changed.
+type watcher interface {
+  Close() error
+}
+
+// Starts watching the sources of the server, preferring notifications from
+// the OS and falling back to polling if they're not available
+func (s *fileServer) watch() watcher {
+  if s.config.FS == nil {
+    w, err := newNotifyWatcher(s)
+    if err == nil {
+      return w
+    }
+  }
+  return newPollWatcher(s)
+}
+
+// Everything an asset was built from, used to figure out which assets a
+// change to a source file affects
+type assetSources struct {
+  /* Names of source files, and logical names of all assets in the bundle or
+     linked to from it */
+  names map[string]bool
+
+  /* Logical directories listed by require_directory, and by require_tree
+     with a "/..." suffix */
+  dirs map[string]bool
+}
+
+func newAssetSources(a Asset) *assetSources {
+  s := &assetSources{ names: make(map[string]bool),
+                      dirs: make(map[string]bool) }
+  s.add(unwrap(a))
+  return s
+}
+
+func (s *assetSources) add(a Asset) {
+  logical := path.Join("/", a.LogicalName())
+  if s.names[logical] {
+    return
+  }
+  s.names[logical] = true
+  p, ok := a.(*processedAsset)
+  if !ok {
+    s.names[a.Pathname()] = true
+    return
+  }
+  s.names[p.static.pathname] = true
+  for dir := range p.directories {
+    s.dirs[dir] = true
+  }
+  for _, f := range p.flattened {
+    s.add(f)
+  }
+  /* Linked assets are built separately, so a change to one of them reaches
+     this asset through the logical name */
+  for _, l := range p.links {
+    s.names[path.Join("/", l.LogicalName())] = true
+  }
+}
+
+// Tests whether a change to the source file 'name', which is the asset
+// 'logical', affects the asset these are the sources of
+func (s *assetSources) affected(name, logical string) bool {
+  if s.names[name] || s.names[logical] {
+    return true
+  }
+  /* Files appearing or disappearing change what's in listed directories */
+  dir := path.Dir(logical)
+  for d := range s.dirs {
+    if d == dir {
+      return true
+    } else if tree := strings.TrimSuffix(d, "/..."); tree != d {
+      prefix := strings.TrimSuffix(tree, "/") + "/"
+      if dir == tree || strings.HasPrefix(dir, prefix) {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+// Invoked by watchers whenever source files change. Only assets which were
+// built from the changed files, or which include or link to assets that were,
+// are checked again.
+func (s *fileServer) changed(names []string) {
+  atomic.AddUint64(&s.generation, 1)
+  s.Lock()
+  dirty := make(map[string]bool)
+  for logical, m := range s.assets {
+    if m.sources == nil || names == nil {
+      dirty[logical] = true
+      continue
+    }
+    for _, name := range names {
+      changed := path.Join("/", s.registry().logicalName(s.relativeName(name)))
+      if m.sources.affected(name, changed) {
+        dirty[logical] = true
+        break
+      }
+    }
+  }
+  for more := true; more; {
+    more = false
+    for logical, m := range s.assets {
+      if dirty[logical] {
+        continue
+      }
+      for other := range dirty {
+        if m.sources.names[other] {
+          dirty[logical] = true
+          more = true
+          break
+        }
+      }
+    }
+  }
+  for logical := range dirty {
+    atomic.StoreInt32(&s.assets[logical].dirty, 1)
+  }
+  s.Unlock()
+
+  if s.reloader != nil {
+    s.reloader.notify()
+  }
+}
+
+// Records what an asset was built from after building it. The build may have
+// raced with changes to its sources, in which case the asset is checked again
+// the next time it's asked for.
+func (s *fileServer) built(m *assetMeta, generation uint64) {
+  if s.watcher == nil {
+    return
+  }
+  sources := newAssetSources(m.Asset)
+  s.Lock()
+  m.sources = sources
+  s.Unlock()
+  if atomic.LoadUint64(&s.generation) != generation {
+    atomic.StoreInt32(&m.dirty, 1)
+  }
+}
+
+// Tests whether an asset needs to be rebuilt. When watching for changes, this
+// only touches the filesystem if something the asset was built from has
+// changed since the last time the asset was checked.
+func (s *fileServer) stale(m *assetMeta) bool {
+  if s.watcher == nil {
+    return m.Stale()
+  }
+  if atomic.SwapInt32(&m.dirty, 0) == 0 {
+    return false
+  }
+  return m.Stale()
+}
+
+// Tests whether changes to the given file are interesting, which they're not
+// if they're generated by the server itself or the file is ignored
+func (s *fileServer) watched(name string) bool {
+  rel, err := filepath.Rel(s.config.TempDir, name)
+  if err == nil && !strings.HasPrefix(rel, "..") {
+    return false
+  }
+  for _, root := range s.roots() {
+    if rel, ok := s.relativeTo(root, name); ok {
+      return !s.ignored(root, rel)
+    }
+  }
+  return true
+}
+
+// Fallback watcher which scans all sources periodically for changes
+type pollWatcher struct {
+  done   chan bool
+  closed sync.Once
+}
+
+// Identifies the version of a source file seen while polling
+type pollState struct {
+  mtime time.Time
+  size  int64
+}
+
+func newPollWatcher(s *fileServer) *pollWatcher {
+  w := &pollWatcher{ done: make(chan bool) }
+  interval := s.config.PollInterval
+  if interval <= 0 {
+    interval = time.Second
+  }
+  prev := w.scan(s)
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+      select {
+      case <-w.done:
+        return
+      case <-ticker.C:
+      }
+      cur := w.scan(s)
+      changed := make([]string, 0)
+      for name, state := range cur {
+        if prev[name] != state {
+          changed = append(changed, name)
+        }
+      }
+      for name := range prev {
+        if _, ok := cur[name]; !ok {
+          changed = append(changed, name)
+        }
+      }
+      if len(changed) > 0 {
+        s.changed(changed)
+      }
+      prev = cur
+    }
+  }()
+  return w
+}
+
+func (w *pollWatcher) scan(s *fileServer) map[string]pollState {
+  files := make(map[string]pollState)
+  s.walk(func(root, name string) error {
+    if !s.watched(name) {
+      return nil
+    }
+    var stat fs.FileInfo
+    var err error
+    if s.config.FS == nil {
+      stat, err = os.Stat(name)
+    } else {
+      stat, err = fs.Stat(s.config.FS, name)
+    }
+    if err == nil {
+      files[name] = pollState{ mtime: stat.ModTime(), size: stat.Size() }
+    }
+    return nil
+  })
+  return files
+}
+
+func (w *pollWatcher) Close() error {
+  w.closed.Do(func() { close(w.done) })
+  return nil
+}
@@ -0,0 +1,136 @@
+package paste
+
+import "os"
+import "path/filepath"
+import "sync"
+import "syscall"
+import "unsafe"
+
+// Watcher which uses inotify to be told about changes to sources
+type notifyWatcher struct {
+  fd      int
+  file    *os.File
+  srv     *fileServer
+  watches map[int32]string
+  closed  sync.Once
+  sync.Mutex
+}
+
+const notifyEvents = syscall.IN_MODIFY | syscall.IN_ATTRIB |
+                     syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+                     syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+                     syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+func newNotifyWatcher(s *fileServer) (watcher, error) {
+  fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+  if err != nil {
+    return nil, err
+  }
+  /* A non-blocking descriptor goes through the runtime's poller, so closing
+     the file interrupts the reading goroutine */
+  w := &notifyWatcher{ fd: fd, file: os.NewFile(uintptr(fd), "inotify"),
+                       srv: s, watches: make(map[int32]string) }
+  for _, root := range s.roots() {
+    if _, err = w.add(root); err != nil {
+      w.file.Close()
+      return nil, err
+    }
+  }
+  go w.read()
+  return w, nil
+}
+
+// Adds watches for a directory and everything underneath it, returning the
+// names of all files found in it
+func (w *notifyWatcher) add(dir string) ([]string, error) {
+  found := make([]string, 0)
+  err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+    if err != nil {
+      /* things disappearing from underneath us will be noticed anyway */
+      return nil
+    }
+    if !info.IsDir() {
+      if w.srv.watched(name) {
+        found = append(found, name)
+      }
+      return nil
+    } else if !w.srv.watched(name) {
+      return filepath.SkipDir
+    }
+    wd, err := syscall.InotifyAddWatch(w.fd, name, notifyEvents)
+    if err != nil {
+      return err
+    }
+    w.Lock()
+    w.watches[int32(wd)] = name
+    w.Unlock()
+    return nil
+  })
+  return found, err
+}
+
+func (w *notifyWatcher) read() {
+  buf := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+  for {
+    n, err := w.file.Read(buf)
+    if err != nil {
+      return
+    }
+    w.events(buf[:n])
+  }
+}
+
+// Tells the server about the changes described by a buffer of inotify events
+func (w *notifyWatcher) events(buf []byte) {
+  changed := make([]string, 0)
+  for offset := 0; offset + syscall.SizeofInotifyEvent <= len(buf); {
+    event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+    start := offset + syscall.SizeofInotifyEvent
+    offset = start + int(event.Len)
+    nameBytes := buf[start:offset]
+    for len(nameBytes) > 0 && nameBytes[len(nameBytes) - 1] == 0 {
+      nameBytes = nameBytes[:len(nameBytes) - 1]
+    }
+
+    /* Events were dropped, so there's no telling what changed. Directories
+       created in the meantime may not be watched either */
+    if event.Mask & syscall.IN_Q_OVERFLOW != 0 {
+      for _, root := range w.srv.roots() {
+        w.add(root)
+      }
+      w.srv.changed(nil)
+      return
+    }
+
+    w.Lock()
+    dir, ok := w.watches[event.Wd]
+    if event.Mask & syscall.IN_IGNORED != 0 {
+      delete(w.watches, event.Wd)
+    }
+    w.Unlock()
+    if !ok {
+      continue
+    }
+    name := filepath.Join(dir, string(nameBytes))
+    if !w.srv.watched(name) {
+      continue
+    }
+    /* new directories need watching too, and whatever was put in them
+       before they were watched has changed as well */
+    if event.Mask & syscall.IN_ISDIR != 0 &&
+       event.Mask & (syscall.IN_CREATE | syscall.IN_MOVED_TO) != 0 {
+      found, _ := w.add(name)
+      changed = append(changed, found...)
+    }
+    changed = append(changed, name)
+  }
+  if len(changed) > 0 {
+    w.srv.changed(changed)
+  }
+}
+
+func (w *notifyWatcher) Close() error {
+  var err error
+  w.closed.Do(func() { err = w.file.Close() })
+  return err
+}
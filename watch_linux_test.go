@@ -0,0 +1,45 @@
+package paste
+
+import "os"
+import "path/filepath"
+import "sync/atomic"
+import "syscall"
+import "testing"
+import "time"
+import "unsafe"
+
+func TestWatchOverflow(t *testing.T) {
+  srv, wd := stubWatchServer(t, time.Hour)
+  defer os.RemoveAll(wd)
+  w, err := newNotifyWatcher(srv)
+  check(t, err)
+  srv.watcher = w
+  defer srv.Close()
+  _, err = srv.Asset("foo.js")
+  check(t, err)
+
+  /* everything is checked again after events are lost, and directories made
+     while they were being lost are watched */
+  stubFile(t, wd, "lib/a.js", "a")
+  buf := make([]byte, syscall.SizeofInotifyEvent)
+  event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+  event.Wd = -1
+  event.Mask = syscall.IN_Q_OVERFLOW
+  w.(*notifyWatcher).events(buf)
+
+  srv.Lock()
+  dirty := atomic.LoadInt32(&srv.assets["/foo.js"].dirty)
+  srv.Unlock()
+  if dirty == 0 {
+    t.Errorf("foo.js should be checked again")
+  }
+  found := false
+  w.(*notifyWatcher).Lock()
+  for _, dir := range w.(*notifyWatcher).watches {
+    found = found || dir == filepath.Join(wd, "lib")
+  }
+  w.(*notifyWatcher).Unlock()
+  if !found {
+    t.Errorf("lib should be watched")
+  }
+}
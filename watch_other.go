@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package paste
+
+import "errors"
+
+func newNotifyWatcher(s *fileServer) (watcher, error) {
+  return nil, errors.New("filesystem notifications aren't supported")
+}
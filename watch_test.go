@@ -0,0 +1,213 @@
+package paste
+
+import "bufio"
+import "io/ioutil"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync/atomic"
+import "testing"
+import "time"
+
+func waitForChange(t *testing.T, srv *fileServer, logical, digest string) {
+  for i := 0; i < 500; i++ {
+    a, err := srv.Asset(logical)
+    if err == nil && a.Digest() != digest {
+      return
+    }
+    time.Sleep(10 * time.Millisecond)
+  }
+  t.Fatalf("never noticed %s changing", logical)
+}
+
+func stubWatchServer(t *testing.T, interval time.Duration) (*fileServer,
+                                                             string) {
+  tmpdir, err := ioutil.TempDir(os.TempDir(), "paste")
+  check(t, err)
+  stubFile(t, tmpdir, "foo.js", "a")
+  srv := FileServer(Config{Root: tmpdir, PollInterval: interval})
+  return srv.(*fileServer), tmpdir
+}
+
+func TestWatch(t *testing.T) {
+  tmpdir, err := ioutil.TempDir(os.TempDir(), "paste")
+  check(t, err)
+  defer os.RemoveAll(tmpdir)
+  stubFile(t, tmpdir, "foo.js", "a")
+  srv := FileServer(Config{Root: tmpdir, Watch: true}).(*fileServer)
+  defer srv.Close()
+
+  a, err := srv.Asset("foo.js")
+  check(t, err)
+  check(t, ioutil.WriteFile(filepath.Join(tmpdir, "foo.js"), []byte("b"), 0644))
+  waitForChange(t, srv, "foo.js", a.Digest())
+
+  /* new directories are watched as well */
+  stubFile(t, tmpdir, "sub/dir/foo.js", "a")
+  waitForChange(t, srv, "sub/dir/foo.js", "")
+  a, err = srv.Asset("sub/dir/foo.js")
+  check(t, err)
+  stubFile(t, tmpdir, "sub/dir/foo.js", "b")
+  waitForChange(t, srv, "sub/dir/foo.js", a.Digest())
+}
+
+func TestWatchPolling(t *testing.T) {
+  srv, wd := stubWatchServer(t, 10 * time.Millisecond)
+  defer os.RemoveAll(wd)
+  srv.watcher = newPollWatcher(srv)
+  defer srv.Close()
+
+  a, err := srv.Asset("foo.js")
+  check(t, err)
+  check(t, ioutil.WriteFile(filepath.Join(wd, "foo.js"), []byte("b"), 0644))
+  waitForChange(t, srv, "foo.js", a.Digest())
+}
+
+func TestWatchSkipsFilesystem(t *testing.T) {
+  srv, wd := stubWatchServer(t, time.Hour)
+  defer os.RemoveAll(wd)
+  srv.watcher = newPollWatcher(srv)
+  defer srv.Close()
+
+  _, err := srv.Asset("foo.js")
+  check(t, err)
+
+  /* Nothing has changed according to the watcher, so the filesystem isn't
+     consulted at all */
+  check(t, os.Remove(filepath.Join(wd, "foo.js")))
+  _, err = srv.Asset("foo.js")
+  check(t, err)
+
+  srv.changed(nil)
+  if _, err = srv.Asset("foo.js"); err == nil {
+    t.Errorf("expected an error after the change was noticed")
+  }
+}
+
+func TestWatchCachesListings(t *testing.T) {
+  srv, wd := stubWatchServer(t, time.Hour)
+  defer os.RemoveAll(wd)
+  srv.watcher = newPollWatcher(srv)
+  defer srv.Close()
+
+  if _, err := srv.Asset("bar.js"); err == nil {
+    t.Fatalf("bar.js shouldn't exist yet")
+  }
+  /* The listing of the directory is remembered until a change is noticed */
+  stubFile(t, wd, "bar.js.tmpl", "bar")
+  if _, err := srv.resolve("/bar.js"); err == nil {
+    t.Errorf("expected the old listing to be used")
+  }
+  srv.changed([]string{filepath.Join(wd, "bar.js.tmpl")})
+  _, err := srv.Asset("bar.js")
+  check(t, err)
+}
+
+func TestCloseTwice(t *testing.T) {
+  tmpdir, err := ioutil.TempDir(os.TempDir(), "paste")
+  check(t, err)
+  defer os.RemoveAll(tmpdir)
+  srv := FileServer(Config{Root: tmpdir, LiveReload: true}).(*fileServer)
+  check(t, srv.Close())
+  check(t, srv.Close())
+
+  poll := FileServer(Config{Root: tmpdir}).(*fileServer)
+  poll.watcher = newPollWatcher(poll)
+  check(t, poll.Close())
+  check(t, poll.Close())
+}
+
+func TestLiveReload(t *testing.T) {
+  tmpdir, err := ioutil.TempDir(os.TempDir(), "paste")
+  check(t, err)
+  defer os.RemoveAll(tmpdir)
+  stubFile(t, tmpdir, "foo.js", "a")
+  srv := FileServer(Config{Root: tmpdir, LiveReload: true,
+                           PollInterval: 10 * time.Millisecond}).(*fileServer)
+  defer srv.Close()
+  server := httptest.NewServer(srv)
+  defer server.Close()
+
+  resp, err := http.Get(server.URL + "/__paste/livereload.js")
+  check(t, err)
+  resp.Body.Close()
+  if resp.StatusCode != 200 {
+    t.Fatalf("couldn't fetch the script: %d", resp.StatusCode)
+  }
+
+  _, err = srv.Asset("foo.js")
+  check(t, err)
+  resp, err = http.Get(server.URL + "/__paste/events")
+  check(t, err)
+  defer resp.Body.Close()
+  if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+    t.Fatalf("wrong content type: %s", ct)
+  }
+
+  check(t, ioutil.WriteFile(filepath.Join(tmpdir, "foo.js"), []byte("b"), 0644))
+  lines := bufio.NewScanner(resp.Body)
+  for lines.Scan() {
+    if strings.HasPrefix(lines.Text(), "data: ") {
+      if lines.Text() != "data: /foo.js" {
+        t.Errorf("wrong event: %s", lines.Text())
+      }
+      return
+    }
+  }
+  t.Fatalf("never heard about the change: %v", lines.Err())
+}
+
+func TestWatchIgnored(t *testing.T) {
+  srv, wd := stubServer(t)
+  defer os.RemoveAll(wd)
+  srv.config.Ignore = []string{"*.orig"}
+
+  for name, expected := range map[string]bool{
+    "foo.js": true,
+    "lib/foo.js": true,
+    "foo.js.orig": false,
+    ".foo.js.swp": false,
+    "lib/#foo.js#": false,
+    "tmp/foo.js": false,
+  } {
+    if srv.watched(filepath.Join(wd, name)) != expected {
+      t.Errorf("expected watched(%s) to be %v", name, expected)
+    }
+  }
+}
+
+func TestWatchOnlyAffected(t *testing.T) {
+  srv, wd := stubWatchServer(t, time.Hour)
+  defer os.RemoveAll(wd)
+  srv.watcher = newPollWatcher(srv)
+  defer srv.Close()
+  stubFile(t, wd, "bar.js", "//= require_tree ./lib\nbar")
+  stubFile(t, wd, "lib/a.js", "a")
+  stubFile(t, wd, "baz.js", "//= require bar\nbaz")
+
+  for _, logical := range []string{"foo.js", "bar.js", "baz.js"} {
+    _, err := srv.Asset(logical)
+    check(t, err)
+  }
+  dirty := func(logical string) bool {
+    srv.Lock()
+    defer srv.Unlock()
+    return atomic.LoadInt32(&srv.assets[logical].dirty) != 0
+  }
+
+  /* a new file in a required tree affects everything including it */
+  srv.changed([]string{filepath.Join(wd, "lib/sub/b.js")})
+  if dirty("/foo.js") || dirty("/lib/a.js") {
+    t.Errorf("only what includes lib should be checked again")
+  }
+  if !dirty("/bar.js") || !dirty("/baz.js") {
+    t.Errorf("everything requiring lib should be checked again")
+  }
+
+  srv.changed([]string{filepath.Join(wd, "foo.js")})
+  if !dirty("/foo.js") {
+    t.Errorf("foo.js changed")
+  }
+}
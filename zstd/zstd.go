@@ -0,0 +1,19 @@
+// Package for generating zstd-encoded copies of compiled assets.
+//
+// When imported, this package registers the "zstd" content-coding with paste so
+// that Compile() writes a '.zst' file at the best compression level next to
+// every compiled asset. Compiled servers will serve these files to clients
+// which accept zstd whether or not this package is imported.
+package zstd
+
+import "github.com/klauspost/compress/zstd"
+import "github.com/alexcrichton/go-paste"
+import "io"
+
+func init() {
+  paste.RegisterEncoding(paste.EncoderFunc(encode), "zstd", ".zst")
+}
+
+func encode(w io.Writer) (io.WriteCloser, error) {
+  return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+}